@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media/rtpdump"
+)
+
+// trackSpan tracks the range of RTP timestamps seen on a track, allowing for wraparound.
+type trackSpan struct {
+	started  bool
+	prev     uint32
+	ext      int64
+	min, max int64
+}
+
+func (t *trackSpan) add(ts uint32) {
+	if !t.started {
+		t.started = true
+		t.prev = ts
+		return
+	}
+	t.ext += int64(int32(ts - t.prev))
+	t.prev = ts
+	if t.ext < t.min {
+		t.min = t.ext
+	}
+	if t.ext > t.max {
+		t.max = t.ext
+	}
+}
+
+// AnalyzeRecording reads a recording's rtpdump stream and fills in its duration,
+// packet count, video resolution and key frame index.
+func AnalyzeRecording(rec *Recording, r io.Reader) error {
+	dr, _, err := rtpdump.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	codec := strings.ToUpper(rec.VideoCodec())
+	spans := map[uint8]*trackSpan{}
+
+	rec.Packets = 0
+	rec.Duration = 0
+	rec.KeyFrames = nil
+	var lastKeyFrameTs uint32
+
+	for {
+		dpkt, err := dr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if dpkt.IsRTCP {
+			continue
+		}
+
+		pkt := rtp.Packet{}
+		if err = pkt.Unmarshal(dpkt.Payload); err != nil {
+			continue
+		}
+		index := rec.Packets
+		rec.Packets++
+
+		if d := dpkt.Offset.Seconds(); d > rec.Duration {
+			rec.Duration = d
+		}
+
+		span, ok := spans[pkt.PayloadType]
+		if !ok {
+			span = &trackSpan{}
+			spans[pkt.PayloadType] = span
+		}
+		span.add(pkt.Timestamp)
+
+		t := rec.Track(pkt.PayloadType)
+		if t != nil && t.Kind == webrtc.RTPCodecTypeAudio.String() {
+			continue
+		}
+
+		if rec.Width == 0 {
+			rec.Width, rec.Height = videoPacketSize(codec, pkt.Payload)
+		}
+
+		// Key frames can span several packets and H264 key frames start with their parameter
+		// sets, so only the first matching packet of each frame is indexed.
+		if videoPacketIsKeyFrame(codec, pkt.Payload) {
+			if n := len(rec.KeyFrames); n == 0 || pkt.Timestamp != lastKeyFrameTs {
+				rec.KeyFrames = append(rec.KeyFrames, KeyFrame{Offset: dpkt.Offset.Seconds(), Packet: index})
+				lastKeyFrameTs = pkt.Timestamp
+			}
+		}
+	}
+
+	for pt, span := range spans {
+		clockRate := uint32(videoClockRate)
+		if t := rec.Track(pt); t != nil && t.ClockRate != 0 {
+			clockRate = t.ClockRate
+		} else if t != nil && t.Kind == webrtc.RTPCodecTypeAudio.String() {
+			clockRate = audioClockRate
+		}
+
+		if d := float64(span.max-span.min) / float64(clockRate); d > rec.Duration {
+			rec.Duration = d
+		}
+	}
+	return nil
+}
+
+// videoPacketIsKeyFrame reports whether the packet starts a video key frame.
+func videoPacketIsKeyFrame(codec string, payload []byte) bool {
+	switch codec {
+	case webrtc.VP8:
+		frame, ok := vp8FrameStart(payload)
+		return ok && vp8IsKeyFrame(frame)
+	case webrtc.VP9:
+		d, err := parseVP9PayloadDescriptor(payload)
+		return err == nil && d.StartOfFrame && !d.InterPicture && d.SpatialID == 0
+	case webrtc.H264:
+		return h264IsKeyFrame(payload)
+	}
+	return false
+}
+
+// videoPacketSize returns the picture dimensions if the packet starts a key frame (VP8, VP9)
+// or carries a sequence parameter set (H264).
+func videoPacketSize(codec string, payload []byte) (width, height int) {
+	switch codec {
+	case webrtc.VP8:
+		if frame, ok := vp8FrameStart(payload); ok {
+			if w, h, ok := vp8KeyFrameSize(frame); ok {
+				return w, h
+			}
+		}
+	case webrtc.VP9:
+		if d, err := parseVP9PayloadDescriptor(payload); err == nil && d.Width > 0 {
+			return d.Width, d.Height
+		}
+		if frame, ok := vp9FrameStart(payload); ok {
+			if w, h, ok := vp9KeyFrameSize(frame); ok {
+				return w, h
+			}
+		}
+	case webrtc.H264:
+		for _, nalu := range h264NALUs(payload) {
+			if nalu[0]&h264NALUTypeMask != h264NALUTypeSPS {
+				continue
+			}
+			if w, h, err := h264SPSSize(nalu); err == nil {
+				return w, h
+			}
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RecordingInfo is the REST representation of a stored recording.
+type RecordingInfo struct {
+	*Recording
+	Codecs []string `json:"codecs"`
+
+	// KeyFrames hides the recording's key frame index, which grows with its length, from the
+	// recordings list. It is only set when a single recording is described.
+	KeyFrames []KeyFrame `json:"keyFrames,omitempty"`
+}
+
+// recordingInfo builds the REST representation of a recording. Recordings stored before
+// they were analyzed on save are analyzed on the fly.
+func (s *SignalServer) recordingInfo(rec *Recording) *RecordingInfo {
+	if rec.Packets == 0 && rec.Size > 0 {
+		if rc, err := s.services.Recordings.Open(rec.ID); err == nil {
+			if err = AnalyzeRecording(rec, rc); err != nil {
+				log.Printf("Unable to analyze recording %s: %s\n", rec.ID, err)
+			}
+			rc.Close()
+		}
+	}
+
+	info := RecordingInfo{Recording: rec, Codecs: []string{}}
+	for _, t := range rec.Tracks {
+		info.Codecs = append(info.Codecs, t.Codec)
+	}
+	return &info
+}
+
+// recordingsHandler serves GET /api/recordings, the recordings the caller may play back.
+func (s *SignalServer) recordingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := s.authorize(w, r, "")
+	if p == nil {
+		return
+	}
+
+	infos := []*RecordingInfo{}
+	for _, rec := range s.services.ReadableRecordings(p) {
+		infos = append(infos, s.recordingInfo(rec))
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// recordingHandler serves GET and DELETE /api/recordings/{id} and the per recording
+// resources beneath it. Recordings the caller may not play back are not found.
+func (s *SignalServer) recordingHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/recordings/"), "/", 2)
+	id := parts[0]
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	p := s.authorize(w, r, "")
+	if p == nil {
+		return
+	}
+
+	rec, err := s.services.Recordings.Get(id)
+	if err == nil && !p.CanRead(rec) {
+		err = ErrRecordingNotFound
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if len(parts) > 1 {
+		switch parts[1] {
+		case "export":
+			s.exportHandler(w, r, rec)
+		case "thumbnail.png":
+			s.thumbnailHandler(w, r, rec)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		info := s.recordingInfo(rec)
+		info.KeyFrames = rec.KeyFrames
+		writeJSON(w, http.StatusOK, info)
+
+	case http.MethodDelete:
+		if !p.CanDelete(rec) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		err = s.services.Recordings.Delete(id)
+		if err == ErrRecordingNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Recording %s deleted.\n", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// exportHandler serves GET /api/recordings/{id}/export?format=ivf|h264.
+func (s *SignalServer) exportHandler(w http.ResponseWriter, r *http.Request, rec *Recording) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = DefaultExportFormat(rec)
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported export format %s", format), http.StatusBadRequest)
+		return
+	}
+
+	rc, err := s.services.Recordings.Open(rec.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	// Export into memory first so that failures can still be reported with an error status.
+	buf := bytes.Buffer{}
+	err = ExportRecording(rec, rc, format, &buf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", rec.ID, format))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Printf("Unable to send export of recording %s: %s\n", rec.ID, err)
+	}
+}
+
+// thumbnailHandler serves GET /api/recordings/{id}/thumbnail.png, the first key frame of the recording.
+func (s *SignalServer) thumbnailHandler(w http.ResponseWriter, r *http.Request, rec *Recording) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rc, err := s.services.Recordings.Open(rec.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	img, err := RecordingThumbnail(rec, rc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	buf := bytes.Buffer{}
+	err = png.Encode(&buf, img)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Recordings never change, so neither does their thumbnail.
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Printf("Unable to send thumbnail of recording %s: %s\n", rec.ID, err)
+	}
+}
+
+// clientsHandler serves GET /api/clients. Admins only.
+func (s *SignalServer) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.authorize(w, r, RoleAdmin) == nil {
+		return
+	}
+
+	infos := []ClientInfo{}
+	for _, c := range s.clients.List() {
+		infos = append(infos, c.Info())
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// clientHandler serves GET and DELETE /api/clients/{id}. Deleting a client disconnects it;
+// a recording in progress is saved. Admins only.
+func (s *SignalServer) clientHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/clients/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if s.authorize(w, r, RoleAdmin) == nil {
+		return
+	}
+
+	c := s.clients.Get(id)
+	if c == nil {
+		http.Error(w, "client not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, c.Info())
+
+	case http.MethodDelete:
+		log.Printf("Disconnecting Client %s.\n", id)
+		c.Close()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Unable to write json response: %s\n", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Roles granted to authenticated callers. Admins have every right.
+const (
+	RoleRecord   = "record"   // record over the signal socket or WHIP and manage their own recordings
+	RolePlayback = "playback" // play back, export and watch live any recording
+	RoleAdmin    = "admin"    // everything, including the clients API and metrics
+)
+
+var (
+	errMissingToken = errors.New("missing token")
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token has expired")
+)
+
+// AuthConfig configures the tokens accepted by the signal socket, the REST API and WHIP/WHEP.
+// Everything is open to anyone when neither API keys nor a JWT secret are configured.
+type AuthConfig struct {
+	// APIKeys maps static API keys to the principal they authenticate.
+	APIKeys map[string]Principal `json:"apiKeys"`
+
+	// JWTSecret verifies HS256 signed JSON web tokens. The subject is taken from the "sub"
+	// claim and the roles from the "roles" claim. "exp" and "nbf" are honored when present.
+	JWTSecret string `json:"jwtSecret"`
+}
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Subject string   `json:"subject"`
+	Roles   []string `json:"roles"`
+}
+
+// anonymous is the principal of every caller when authentication is disabled.
+var anonymous = &Principal{Roles: []string{RoleAdmin}}
+
+// HasRole reports whether the principal has been granted the role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// owns reports whether the principal owns a resource with the given owner.
+func (p *Principal) owns(owner string) bool {
+	return owner != "" && owner == p.Subject
+}
+
+// CanRead reports whether the principal may play back, export or describe a recording.
+func (p *Principal) CanRead(rec *Recording) bool {
+	return p.HasRole(RolePlayback) || p.owns(rec.Owner)
+}
+
+// CanDelete reports whether the principal may delete a recording.
+func (p *Principal) CanDelete(rec *Recording) bool {
+	return p.HasRole(RoleAdmin) || p.owns(rec.Owner)
+}
+
+// CanWatch reports whether the principal may watch a live session.
+func (p *Principal) CanWatch(session *LiveSession) bool {
+	return p.HasRole(RolePlayback) || p.owns(session.owner)
+}
+
+// Authenticator checks the tokens presented by callers.
+type Authenticator struct {
+	config AuthConfig
+}
+
+// CreateNewAuthenticator creates an authenticator accepting the configured tokens.
+func CreateNewAuthenticator(config AuthConfig) *Authenticator {
+	return &Authenticator{config: config}
+}
+
+// Enabled reports whether callers must present a token.
+func (a *Authenticator) Enabled() bool {
+	return len(a.config.APIKeys) > 0 || a.config.JWTSecret != ""
+}
+
+// Authenticate returns the principal a token authenticates.
+func (a *Authenticator) Authenticate(token string) (*Principal, error) {
+	if !a.Enabled() {
+		return anonymous, nil
+	}
+	if token == "" {
+		return nil, errMissingToken
+	}
+
+	for key, p := range a.config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			principal := p
+			return &principal, nil
+		}
+	}
+
+	if a.config.JWTSecret != "" && strings.Count(token, ".") == 2 {
+		return a.verifyJWT(token)
+	}
+	return nil, errInvalidToken
+}
+
+// verifyJWT verifies an HS256 signed JSON web token.
+// https://tools.ietf.org/html/rfc7519
+func (a *Authenticator) verifyJWT(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, errInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, []byte(a.config.JWTSecret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errInvalidToken
+	}
+
+	claims := struct {
+		Subject   string   `json:"sub"`
+		Roles     []string `json:"roles"`
+		ExpiresAt int64    `json:"exp"`
+		NotBefore int64    `json:"nbf"`
+	}{}
+	if err = decodeJWTPart(parts[1], &claims); err != nil || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+
+	now := time.Now().Unix()
+	if (claims.ExpiresAt != 0 && now >= claims.ExpiresAt) || claims.NotBefore > now {
+		return nil, errExpiredToken
+	}
+
+	return &Principal{Subject: claims.Subject, Roles: claims.Roles}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// requestToken returns the bearer token of a request. Browsers cannot set headers on websocket
+// requests, so the token can also be given in the token query parameter.
+func requestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authorize authenticates a request and checks that the caller has the role, if one is given.
+// The error response is written and nil returned when the caller is not allowed.
+func (s *SignalServer) authorize(w http.ResponseWriter, r *http.Request, role string) *Principal {
+	p, err := s.auth.Authenticate(requestToken(r))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pion-the-sky"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+	if role != "" && !p.HasRole(role) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "secret"
+
+// testJWT signs a token with the given header and claims using HMAC-SHA256.
+func testJWT(t *testing.T, secret string, header, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signed := enc(header) + "." + enc(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthenticateJWT(t *testing.T) {
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	now := time.Now().Unix()
+	valid := testJWT(t, testJWTSecret, hs256, map[string]interface{}{"sub": "alice", "roles": []string{RoleRecord}})
+	parts := strings.Split(valid, ".")
+	mallory := strings.Split(testJWT(t, "other", hs256, map[string]interface{}{"sub": "mallory"}), ".")
+
+	tests := []struct {
+		name  string
+		token string
+		want  *Principal
+		err   error
+	}{
+		{
+			name:  "valid",
+			token: valid,
+			want:  &Principal{Subject: "alice", Roles: []string{RoleRecord}},
+		},
+		{
+			name:  "not yet expired",
+			token: testJWT(t, testJWTSecret, hs256, map[string]interface{}{"sub": "alice", "exp": now + 60}),
+			want:  &Principal{Subject: "alice"},
+		},
+		{
+			name:  "expired",
+			token: testJWT(t, testJWTSecret, hs256, map[string]interface{}{"sub": "alice", "exp": now - 1}),
+			err:   errExpiredToken,
+		},
+		{
+			name:  "not yet valid",
+			token: testJWT(t, testJWTSecret, hs256, map[string]interface{}{"sub": "alice", "nbf": now + 60}),
+			err:   errExpiredToken,
+		},
+		{
+			name:  "wrong secret",
+			token: testJWT(t, "other", hs256, map[string]interface{}{"sub": "alice"}),
+			err:   errInvalidToken,
+		},
+		{
+			name:  "tampered claims",
+			token: parts[0] + "." + mallory[1] + "." + parts[2],
+			err:   errInvalidToken,
+		},
+		{
+			name:  "algorithm none",
+			token: testJWT(t, testJWTSecret, map[string]interface{}{"alg": "none"}, map[string]interface{}{"sub": "alice"}),
+			err:   errInvalidToken,
+		},
+		{
+			name:  "unsupported algorithm",
+			token: testJWT(t, testJWTSecret, map[string]interface{}{"alg": "HS512"}, map[string]interface{}{"sub": "alice"}),
+			err:   errInvalidToken,
+		},
+		{
+			name:  "unsigned",
+			token: parts[0] + "." + parts[1] + ".",
+			err:   errInvalidToken,
+		},
+		{
+			name:  "missing subject",
+			token: testJWT(t, testJWTSecret, hs256, map[string]interface{}{"roles": []string{RoleAdmin}}),
+			err:   errInvalidToken,
+		},
+		{
+			name:  "malformed",
+			token: "a.b.c",
+			err:   errInvalidToken,
+		},
+		{
+			name:  "missing",
+			token: "",
+			err:   errMissingToken,
+		},
+	}
+
+	a := CreateNewAuthenticator(AuthConfig{JWTSecret: testJWTSecret})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.Authenticate(tt.token)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(p, tt.want) {
+				t.Errorf("got principal %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	a := CreateNewAuthenticator(AuthConfig{
+		APIKeys: map[string]Principal{"key": {Subject: "svc", Roles: []string{RolePlayback}}},
+	})
+
+	p, err := a.Authenticate("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Principal{Subject: "svc", Roles: []string{RolePlayback}}); !reflect.DeepEqual(p, want) {
+		t.Errorf("got principal %+v, want %+v", p, want)
+	}
+
+	// JWTs are not accepted without a secret
+	jwt := testJWT(t, testJWTSecret, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": "alice"})
+	for _, token := range []string{"other", jwt} {
+		if _, err = a.Authenticate(token); err != errInvalidToken {
+			t.Errorf("%q: got error %v, want %v", token, err, errInvalidToken)
+		}
+	}
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	a := CreateNewAuthenticator(AuthConfig{})
+
+	p, err := a.Authenticate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != anonymous || !p.HasRole(RoleAdmin) {
+		t.Errorf("got principal %+v, want the anonymous admin", p)
+	}
+}
+
+func TestPrincipalRecordingRights(t *testing.T) {
+	rec := &Recording{Owner: "alice"}
+
+	tests := []struct {
+		name               string
+		principal          Principal
+		canRead, canDelete bool
+	}{
+		{"owner", Principal{Subject: "alice", Roles: []string{RoleRecord}}, true, true},
+		{"other recorder", Principal{Subject: "bob", Roles: []string{RoleRecord}}, false, false},
+		{"playback", Principal{Subject: "bob", Roles: []string{RolePlayback}}, true, false},
+		{"admin", Principal{Subject: "bob", Roles: []string{RoleAdmin}}, true, true},
+		{"no subject", Principal{Roles: []string{RoleRecord}}, false, false},
+	}
+	for _, tt := range tests {
+		if got := tt.principal.CanRead(rec); got != tt.canRead {
+			t.Errorf("%s: CanRead = %v, want %v", tt.name, got, tt.canRead)
+		}
+		if got := tt.principal.CanDelete(rec); got != tt.canDelete {
+			t.Errorf("%s: CanDelete = %v, want %v", tt.name, got, tt.canDelete)
+		}
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws?token=query", nil)
+	if got := requestToken(r); got != "query" {
+		t.Errorf("got %q from the query, want %q", got, "query")
+	}
+
+	r.Header.Set("Authorization", "Bearer header")
+	if got := requestToken(r); got != "header" {
+		t.Errorf("got %q from the header, want %q", got, "header")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// exportCommand implements the export subcommand which writes a stored recording to a file:
+//
+//	pion-the-sky export -store=<dir> [-format=webm] [-o=<file>] <recording id>
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	storeDir := fs.String("store", "", "Directory the recordings are stored in")
+	format := fs.String("format", ExportWebM, "Export format (ivf, h264, ogg, webm)")
+	out := fs.String("o", "", "Output file. Defaults to <id>.<format>")
+	fs.Parse(args)
+
+	if *storeDir == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("export requires -store and a recording id")
+	}
+	id := fs.Arg(0)
+	*format = strings.ToLower(*format)
+
+	store, err := CreateNewFileRecordingStore(*storeDir)
+	if err != nil {
+		return err
+	}
+
+	rec, err := store.Get(id)
+	if err != nil {
+		return fmt.Errorf("%s: %s", id, err)
+	}
+
+	rc, err := store.Open(id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fn := *out
+	if fn == "" {
+		fn = fmt.Sprintf("%s.%s", id, *format)
+	}
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+
+	err = ExportRecording(rec, rc, *format, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fn)
+		return err
+	}
+
+	log.Printf("Recording %s exported to %s\n", id, fn)
+	return nil
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"sync"
@@ -13,12 +13,16 @@ import (
 
 	guuid "github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/sdp/v2"
 	"github.com/pion/webrtc/v2"
 	"github.com/pion/webrtc/v2/pkg/media/rtpdump"
 )
 
+// minPLIInterval is the minimum time between key frame requests sent to a publisher.
+const minPLIInterval = 500 * time.Millisecond
+
 // PeerClientType represents the types of signal messages
 type PeerClientType int
 
@@ -31,67 +35,144 @@ const (
 
 	// PctPlayback - playback client
 	PctPlayback = PeerClientType(iota)
+
+	// PctLive - live viewing client
+	PctLive = PeerClientType(iota)
 )
 
+func (t PeerClientType) String() string {
+	switch t {
+	case PctRecord:
+		return "record"
+	case PctPlayback:
+		return "playback"
+	case PctLive:
+		return "live"
+	}
+	return "undecided"
+}
+
 // PeerClient represents a server-side client used as a peer to the browser client.
 type PeerClient struct {
-	id string
-	ct PeerClientType
-	pc *webrtc.PeerConnection
-	ws *websocket.Conn
-	pt uint8
+	id  string
+	ct  PeerClientType
+	pc  *webrtc.PeerConnection
+	ws  *websocket.Conn
+	pt  uint8
+	apt uint8
+
+	// Video codec negotiated with the browser
+	vc *webrtc.RTPCodec
 
 	browserSD string
 	serverSD  string
 
-	sdParsed sdp.SessionDescription
+	// Recording ids to play back in order. Empty plays every recording.
+	playlist []string
+
+	// Seek, pause and rate requests of a playback client
+	control *playbackControl
 
-	services *WebRTCService
-	decoder  *vp8.Decoder
+	sdParsed sdp.SessionDescription
 
-	audioBuf *bytes.Buffer
-	videoBuf *bytes.Buffer
+	services  *WebRTCService
+	registry  *ClientRegistry
+	principal *Principal
+	decoder   *vp8.Decoder
+
+	remoteAddr string
+	started    time.Time
+	iceState   webrtc.ICEConnectionState
+
+	// Statistics of the tracks sent to playback and live clients
+	senderStats []*senderStats
+
+	// Audio and video packets are interleaved into a single rtpdump stream as they arrive,
+	// written straight to the recording store.
+	recording    RecordingWriter
+	recordWriter *rtpdump.Writer
+	recordTracks []RecordingTrack
+	recordStart  time.Time
+	recordMutex  sync.Mutex
+
+	// Key frames are requested from the publisher's video track on demand
+	videoSSRC uint32
+	lastPLI   time.Time
+	pliMutex  sync.Mutex
+
+	// Relays recorded packets to live viewers while recording
+	live *LiveSession
+
+	// Trickle ICE candidates waiting on the session descriptions to be exchanged
+	localCandidates  []webrtc.ICECandidateInit
+	remoteCandidates []webrtc.ICECandidateInit
+	answerSent       bool
+	remoteSDSet      bool
+	iceMutex         sync.Mutex
 
 	closeCh chan struct{}
 
-	wg    sync.WaitGroup
-	mutex sync.Mutex
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	wsMutex sync.Mutex
+}
+
+// CreateNewPeerClient creates a new server peer client signaled over the websocket for an
+// authenticated principal and adds it to the registry until it is closed.
+func CreateNewPeerClient(conn *websocket.Conn, principal *Principal, services *WebRTCService, registry *ClientRegistry) (*PeerClient, error) {
+	client := newPeerClient(conn, conn.RemoteAddr().String(), principal, services, registry)
+
+	go client.eventLoop()
+
+	return client, nil
 }
 
-// CreateNewPeerClient creates a new server peer client.
-func CreateNewPeerClient(conn *websocket.Conn, services *WebRTCService) (*PeerClient, error) {
+// CreateNewHTTPPeerClient creates a new server peer client signaled over plain HTTP requests
+// (WHIP and WHEP) for an authenticated principal and adds it to the registry until it is closed.
+// It has no signal socket, so the answer is returned in the response and signal messages are not sent.
+func CreateNewHTTPPeerClient(remoteAddr string, principal *Principal, services *WebRTCService, registry *ClientRegistry) (*PeerClient, error) {
+	return newPeerClient(nil, remoteAddr, principal, services, registry), nil
+}
 
+func newPeerClient(conn *websocket.Conn, remoteAddr string, principal *Principal, services *WebRTCService, registry *ClientRegistry) *PeerClient {
 	client := PeerClient{
 		id:      guuid.New().String(),
 		ct:      PctUndecided,
 		ws:      conn,
 		closeCh: make(chan struct{}),
 
-		audioBuf: bytes.NewBuffer([]byte{}),
-		videoBuf: bytes.NewBuffer([]byte{}),
+		services:  services,
+		registry:  registry,
+		principal: principal,
+		decoder:   vp8.NewDecoder(),
 
-		services: services,
-		decoder:  vp8.NewDecoder(),
+		remoteAddr: remoteAddr,
+		started:    time.Now().UTC(),
+		iceState:   webrtc.ICEConnectionStateNew,
 	}
 
-	log.Printf("Server Peer Client %s created.\n", client.id)
+	registry.Add(&client)
+	log.Printf("Server Peer Client %s created for %s.\n", client.id, client.remoteAddr)
 
-	go client.eventLoop()
-
-	return &client, nil
+	return &client
 }
 
 // Close - closes a client's peer and signal connections.
 func (c *PeerClient) Close() {
-	if c.IsClosed() {
+	// Check and close under the lock as the client can be closed from the api and its event loop at once.
+	c.mutex.Lock()
+	select {
+	case <-c.closeCh:
+		c.mutex.Unlock()
 		return
+	default:
 	}
-
-	c.mutex.Lock()
 	close(c.closeCh)
 	c.mutex.Unlock()
 
-	c.ws.Close()
+	if c.ws != nil {
+		c.ws.Close()
+	}
 
 	if c.pc != nil {
 		c.pc.Close()
@@ -100,12 +181,35 @@ func (c *PeerClient) Close() {
 	c.wg.Wait()
 
 	if c.ct == PctRecord {
-		c.services.SaveVideo(c.id, c.videoBuf)
+		c.services.EndLiveSession(c.id)
+
+		c.recordMutex.Lock()
+		recording := c.recording
+		tracks := c.recordTracks
+		c.recordMutex.Unlock()
+
+		c.services.SaveVideo(c.id, c.principal.Subject, recording, tracks)
 	}
 
+	c.registry.Remove(c.id)
 	log.Printf("Client %s closed.\n", c.id)
 }
 
+// Shutdown tells the browser that the server is going away and closes the client.
+func (c *PeerClient) Shutdown(reason string) {
+	msg := SignalMessage{}
+	msg.id = SmShutdown
+	msg.Data = reason
+	msg.Marshal()
+
+	err := c.writeMessage(&msg)
+	if err != nil {
+		log.Printf("Client %s unable to send shutdown notice: %s\n", c.id, err)
+	}
+
+	c.Close()
+}
+
 func (c *PeerClient) eventLoop() {
 	c.wg.Add(1)
 	defer func() {
@@ -121,6 +225,7 @@ func (c *PeerClient) eventLoop() {
 			return
 		}
 
+		ev = SignalMessage{}
 		err = c.ws.ReadJSON(&ev)
 		if err != nil {
 			log.Printf("Client %s error %s\n", c.id, err)
@@ -135,6 +240,7 @@ func (c *PeerClient) eventLoop() {
 		}
 
 		log.Printf("Client %s received event: %s\n", c.id, ev.Op)
+		metrics.signalMessages.inc(ev.Op)
 
 		switch ev.id {
 		case SmRecord:
@@ -142,8 +248,18 @@ func (c *PeerClient) eventLoop() {
 				c.sendError("Peer client is already either recording or playing. Please disconnect and try again.")
 				continue
 			}
-			c.ct = PctRecord
+			if !c.principal.HasRole(RoleRecord) {
+				c.sendError("You are not allowed to record.")
+				continue
+			}
 			c.browserSD = ev.Data
+			codec, err := c.negotiate(c.services.RecordingCodec)
+			if err != nil {
+				c.sendError(err.Error())
+				continue
+			}
+			c.setType(PctRecord)
+			log.Printf("Client %s recording with %s video.\n", c.id, codec)
 			go func() {
 				c.wg.Add(1)
 				defer c.wg.Done()
@@ -158,12 +274,26 @@ func (c *PeerClient) eventLoop() {
 				c.sendError("Peer client is already either recording or playing. Please disconnect and try again.")
 				continue
 			}
-			if c.services.VideoCount() <= 0 {
+			if c.services.VideoCount(c.principal) <= 0 {
 				c.sendError("There are no recorded videos to playback. Please record a video first.")
 				continue
 			}
-			c.ct = PctPlayback
+			if id, ok := c.canReadAll(ev.IDs); !ok {
+				c.sendError(fmt.Sprintf("Recording %s was not found.", id))
+				continue
+			}
 			c.browserSD = ev.Data
+			codec, err := c.negotiate(func(offered []string) (string, error) {
+				return c.services.PlaybackCodec(c.principal, ev.IDs, offered)
+			})
+			if err != nil {
+				c.sendError(err.Error())
+				continue
+			}
+			c.setType(PctPlayback)
+			c.playlist = ev.IDs
+			c.control = newPlaybackControl()
+			log.Printf("Client %s playing back %s video.\n", c.id, codec)
 			go func() {
 				c.wg.Add(1)
 				defer c.wg.Done()
@@ -172,10 +302,127 @@ func (c *PeerClient) eventLoop() {
 					log.Printf("Client %s error %s\n", c.id, err)
 				}
 			}()
+
+		case SmSeek, SmPause, SmResume, SmRate:
+			if c.ct != PctPlayback {
+				c.sendError("Only a playback stream can be controlled. Please play the recordings first.")
+				continue
+			}
+			if err = c.control.apply(ev.id, ev.Data); err != nil {
+				c.sendError(err.Error())
+				continue
+			}
+
+		case SmCandidate:
+			init := webrtc.ICECandidateInit{}
+			if err = TryDecode(ev.Data, &init); err != nil {
+				log.Printf("Client %s received a malformed ICE candidate: %s\n", c.id, err)
+				continue
+			}
+			c.addRemoteCandidate(init)
+
+		case SmLive:
+			if c.ct != PctUndecided {
+				c.sendError("Peer client is already either recording or playing. Please disconnect and try again.")
+				continue
+			}
+			sessionID := ""
+			if len(ev.IDs) > 0 {
+				sessionID = ev.IDs[0]
+			}
+			session, err := c.services.LiveSession(sessionID)
+			if err != nil || !c.principal.CanWatch(session) {
+				c.sendError("There is no live recording to watch. Please start a recording first.")
+				continue
+			}
+			c.browserSD = ev.Data
+			_, err = c.negotiate(func(offered []string) (string, error) {
+				if !containsCodec(offered, session.codec) {
+					return "", fmt.Errorf("your browser cannot play %s video. Please use a browser that supports %s", session.codec, session.codec)
+				}
+				return session.codec, nil
+			})
+			if err != nil {
+				c.sendError(err.Error())
+				continue
+			}
+			c.setType(PctLive)
+			go func() {
+				c.wg.Add(1)
+				defer c.wg.Done()
+				err := c.services.CreateLiveConnection(c, session)
+				if err != nil {
+					log.Printf("Client %s error %s\n", c.id, err)
+				}
+			}()
 		}
 	}
 }
 
+// canReadAll checks that the client's principal may play back each of the recordings. Returns
+// the first id that cannot be played.
+func (c *PeerClient) canReadAll(ids []string) (string, bool) {
+	for _, id := range ids {
+		rec, err := c.services.Recordings.Get(id)
+		if err != nil || !c.principal.CanRead(rec) {
+			return id, false
+		}
+	}
+	return "", true
+}
+
+func (c *PeerClient) setType(ct PeerClientType) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.ct = ct
+}
+
+// setICEState records the state of the client's ICE connection.
+func (c *PeerClient) setICEState(state webrtc.ICEConnectionState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.iceState = state
+	metrics.iceStates.inc(state.String())
+}
+
+// setSenderStats sets the statistics of the tracks sent to the browser.
+func (c *PeerClient) setSenderStats(stats ...*senderStats) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.senderStats = stats
+}
+
+// Info returns a snapshot of the client's state.
+func (c *PeerClient) Info() ClientInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	info := ClientInfo{
+		ID:         c.id,
+		Subject:    c.principal.Subject,
+		Type:       c.ct.String(),
+		RemoteAddr: c.remoteAddr,
+		ICEState:   c.iceState.String(),
+		Started:    c.started,
+	}
+	for _, s := range c.senderStats {
+		info.Tracks = append(info.Tracks, s.snapshot())
+	}
+	return info
+}
+
+// closeIfUnsignaled closes an HTTP client once its peer connection has failed. Websocket
+// clients are closed when their signal socket closes instead. A disconnected connection
+// may still recover.
+func (c *PeerClient) closeIfUnsignaled(state webrtc.ICEConnectionState) {
+	if c.ws == nil && state != webrtc.ICEConnectionStateDisconnected {
+		go c.Close()
+	}
+}
+
 // IsClosed checks to see if this client has been shutdown
 func (c *PeerClient) IsClosed() bool {
 	c.mutex.Lock()
@@ -191,35 +438,70 @@ func (c *PeerClient) IsClosed() bool {
 	return false
 }
 
+// negotiate parses the browser offer and selects the client's video codec from the codecs it offers.
+func (c *PeerClient) negotiate(choose func(offered []string) (string, error)) (string, error) {
+	offer := webrtc.SessionDescription{}
+	err := TryDecode(c.browserSD, &offer)
+	if err != nil {
+		return "", err
+	}
+
+	c.sdParsed = sdp.SessionDescription{}
+	err = c.sdParsed.Unmarshal([]byte(offer.SDP))
+	if err != nil {
+		return "", err
+	}
+
+	name, err := choose(offeredVideoCodecs(&c.sdParsed))
+	if err != nil {
+		return "", err
+	}
+
+	c.vc, err = newVideoCodec(name)
+	if err != nil {
+		return "", err
+	}
+	return c.vc.Name, nil
+}
+
 // startServerSession - Completes the session initiation with the client.
 func (c *PeerClient) startServerSession() error {
 
 	offer := webrtc.SessionDescription{}
-	Decode(c.browserSD, &offer)
+	err := TryDecode(c.browserSD, &offer)
+	if err != nil {
+		return err
+	}
 
 	// Some browser codec mappings might not match what
 	// pion has. The work around is to pull the payload type
 	// from the browser session description and modify the
 	// streaming rtp packets accordingly. See this issue for
 	// more details: https://github.com/pion/webrtc/issues/716
-	err := c.sdParsed.Unmarshal([]byte(offer.SDP))
-	if err != nil {
-		return err
-	}
 	codec := sdp.Codec{
-		Name: c.services.vc.Name,
+		Name: c.vc.Name,
 	}
 	c.pt, err = c.sdParsed.GetPayloadTypeForCodec(codec)
 	if err != nil {
 		return err
 	}
+	c.apt, err = c.sdParsed.GetPayloadTypeForCodec(sdp.Codec{Name: c.services.ac.Name})
+	if err != nil {
+		// The browser did not offer audio, so there is nothing to remap.
+		c.apt = c.services.ac.PayloadType
+	}
 	// ---
 
+	// Trickle our candidates to the browser as they are gathered. Gathering starts once the
+	// answer is set as the local description.
+	c.pc.OnICECandidate(c.onLocalCandidate)
+
 	// Set the remote session description
 	err = c.pc.SetRemoteDescription(offer)
 	if err != nil {
 		return err
 	}
+	c.applyRemoteCandidates()
 
 	// Create answer
 	answer, err := c.pc.CreateAnswer(nil)
@@ -236,20 +518,118 @@ func (c *PeerClient) startServerSession() error {
 	// Send back the answer (this peer's session description) in base64 to the browser client.
 	// Note modifications may be made to account for known issues. See ModServerSessionDescription()
 	// for more details.
+	// The candidates in it are advertised on the NAT 1:1 public IPs when configured.
+	answer.SDP = c.services.nat.SDP(answer.SDP)
 	c.serverSD = Encode(ModAnswer(&answer))
 
+	// HTTP clients get the answer in the response. They do not trickle, so their candidates
+	// are gathered before the answer is created and it already carries them.
+	if c.ws == nil {
+		return nil
+	}
+
 	msg := SignalMessage{}
 	msg.id = SmAnswer
 	msg.Data = c.serverSD
+	if c.ct == PctRecord {
+		msg.IDs = []string{c.id}
+	}
 	msg.Marshal()
 
-	err = c.ws.WriteJSON(&msg)
+	err = c.writeMessage(&msg)
 	if err != nil {
 		return err
 	}
+	c.sendLocalCandidates()
+
 	return nil
 }
 
+// onLocalCandidate sends a locally gathered ICE candidate to the browser. Candidates gathered
+// before the answer has been sent are queued since the browser cannot apply them yet.
+func (c *PeerClient) onLocalCandidate(candidate *webrtc.ICECandidate) {
+	if candidate == nil {
+		return
+	}
+	// The candidate is advertised on the NAT 1:1 public IPs when configured
+	inits := []webrtc.ICECandidateInit{}
+	for _, value := range c.services.nat.Candidates(candidate.ToJSON().Candidate) {
+		init := candidate.ToJSON()
+		init.Candidate = value
+		inits = append(inits, init)
+	}
+
+	c.iceMutex.Lock()
+	if !c.answerSent {
+		c.localCandidates = append(c.localCandidates, inits...)
+		c.iceMutex.Unlock()
+		return
+	}
+	c.iceMutex.Unlock()
+
+	for _, init := range inits {
+		c.sendCandidate(init)
+	}
+}
+
+// sendLocalCandidates marks the answer as sent and sends any queued local candidates.
+func (c *PeerClient) sendLocalCandidates() {
+	c.iceMutex.Lock()
+	c.answerSent = true
+	pending := c.localCandidates
+	c.localCandidates = nil
+	c.iceMutex.Unlock()
+
+	for _, init := range pending {
+		c.sendCandidate(init)
+	}
+}
+
+func (c *PeerClient) sendCandidate(init webrtc.ICECandidateInit) {
+	msg := SignalMessage{}
+	msg.id = SmCandidate
+	msg.Data = Encode(init)
+	msg.Marshal()
+
+	err := c.writeMessage(&msg)
+	if err != nil {
+		log.Printf("Client %s unable to send ICE candidate: %s\n", c.id, err)
+	}
+}
+
+// addRemoteCandidate applies an ICE candidate trickled from the browser. Candidates received
+// before the browser's session description has been applied are queued.
+func (c *PeerClient) addRemoteCandidate(init webrtc.ICECandidateInit) {
+	c.iceMutex.Lock()
+	if !c.remoteSDSet {
+		c.remoteCandidates = append(c.remoteCandidates, init)
+		c.iceMutex.Unlock()
+		return
+	}
+	c.iceMutex.Unlock()
+
+	err := c.pc.AddICECandidate(init)
+	if err != nil {
+		log.Printf("Client %s unable to add ICE candidate: %s\n", c.id, err)
+	}
+}
+
+// applyRemoteCandidates marks the remote description as set and applies any queued remote candidates.
+func (c *PeerClient) applyRemoteCandidates() {
+	c.iceMutex.Lock()
+	c.remoteSDSet = true
+	pending := c.remoteCandidates
+	c.remoteCandidates = nil
+	c.iceMutex.Unlock()
+
+	for _, init := range pending {
+		err := c.pc.AddICECandidate(init)
+		if err != nil {
+			log.Printf("Client %s unable to add ICE candidate: %s\n", c.id, err)
+		}
+	}
+}
+
 // recordTrack records raw audio and video packets off the given track
 func (c *PeerClient) recordTrack(track *webrtc.Track) error {
 	codec := track.Codec()
@@ -262,28 +642,24 @@ func (c *PeerClient) recordTrack(track *webrtc.Track) error {
 
 	log.Printf("Recording %s track for client id:%s\n", codec.Name, c.id)
 
-	header := rtpdump.Header{
-		Start:  time.Unix(9, 0).UTC(),
-		Source: net.IPv4(2, 2, 2, 2),
-		Port:   2222,
-	}
-
-	var writer *rtpdump.Writer
-	var err error
-
-	if track.Kind() == webrtc.RTPCodecTypeAudio {
-		// Audio track
-		writer, err = rtpdump.NewWriter(c.audioBuf, header)
-	} else {
-		// Video track
-		writer, err = rtpdump.NewWriter(c.videoBuf, header)
-	}
-
+	err := c.addRecordTrack(track)
 	if err != nil {
 		return err
 	}
 	fmt.Printf("Client %s recording %s track\n", c.id, track.Codec().Name)
 
+	kind := track.Kind().String()
+
+	// Packets are reordered and deduplicated before they are recorded. Whatever is still
+	// buffered when the track ends is written before the recording is saved.
+	jb := newJitterBuffer(codec.ClockRate)
+	defer func() {
+		ready, lost := jb.flush()
+		if err := c.writeRecordPackets(track, ready, lost); err != nil {
+			log.Printf("Client %s unable to record the end of the %s track: %s\n", c.id, codec.Name, err)
+		}
+	}()
+
 	for {
 		if c.IsClosed() {
 			break
@@ -293,131 +669,170 @@ func (c *PeerClient) recordTrack(track *webrtc.Track) error {
 		if err != nil {
 			return err
 		}
+		arrival := time.Now()
 
-		raw, _ := rtpPacket.Marshal()
+		// Live viewers get the packets as they arrive; they have jitter buffers of their own
+		if c.live != nil {
+			c.live.Forward(rtpPacket, track.Kind())
+		}
+
+		metrics.rtpPacketsReceived.inc(kind)
+		metrics.rtpBytesReceived.add(kind, float64(rtpPacket.MarshalSize()))
+
+		if !jb.push(rtpPacket, arrival) {
+			metrics.rtpPacketsDiscarded.inc(kind)
+			continue
+		}
+
+		// Ask for the packets missing so far while the jitter buffer waits on them. NACKs are only
+		// negotiated for video, so missing audio packets are waited on and then counted as lost.
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			if seqs := jb.missing(arrival); len(seqs) > 0 {
+				c.requestRetransmission(track, seqs)
+			}
+		}
 
-		dpacket := rtpdump.Packet{
-			Offset:  0,
-			IsRTCP:  false,
-			Payload: raw,
+		ready, lost := jb.pop(arrival)
+		err = c.writeRecordPackets(track, ready, lost)
+		if err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
 
-		writer.WritePacket(dpacket)
+// writeRecordPackets writes packets released by a track's jitter buffer to the recording at
+// their capture time. Lost packets are counted against the track. Lost video packets leave
+// the following frames undecodable until the next key frame.
+func (c *PeerClient) writeRecordPackets(track *webrtc.Track, ready []jitterPacket, lost int) error {
+	if lost > 0 {
+		metrics.rtpPacketsLost.add(track.Kind().String(), float64(lost))
+		c.addRecordTrackLoss(track.PayloadType(), lost)
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			c.requestKeyFrame("packet loss")
+		}
 	}
 
+	for _, p := range ready {
+		raw, err := p.pkt.Marshal()
+		if err != nil {
+			return err
+		}
+		if err = c.writeRecordPacket(raw, p.captured); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// streamVideoToTrack records raw audio and video packets off the given track
-func (c *PeerClient) streamVideoToTrack(outputTrack *webrtc.Track) {
-	codec := outputTrack.Codec()
-	ticker := time.NewTicker(40 * time.Millisecond)
+// requestKeyFrame sends a picture loss indication to the publisher so that it sends a key frame.
+// Requests are rate limited since the publisher needs time to respond.
+func (c *PeerClient) requestKeyFrame(reason string) {
+	c.pliMutex.Lock()
+	ssrc := c.videoSSRC
+	if ssrc == 0 || time.Since(c.lastPLI) < minPLIInterval {
+		c.pliMutex.Unlock()
+		return
+	}
+	c.lastPLI = time.Now()
+	c.pliMutex.Unlock()
 
-	c.wg.Add(1)
-	defer func() {
-		ticker.Stop()
-		log.Printf("StreamTo track loop for %s exiting client id:%s\n", codec.Name, c.id)
-		c.wg.Done()
-	}()
+	err := c.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+	if err != nil {
+		log.Printf("Client %s unable to request a key frame: %s\n", c.id, err)
+		return
+	}
+	metrics.plisSent.inc("")
+	log.Printf("Client %s requested a key frame (%s).\n", c.id, reason)
+}
 
-	rtp := rtp.Packet{}
-	seq := uint16(100)
-	tsbegin := uint32(0)
-	tsmod := uint32(0)
-	tsprev := uint32(0)
-	tsdelta := uint32(0)
+// setVideoSSRC sets the publisher's video track that key frames are requested on.
+func (c *PeerClient) setVideoSSRC(ssrc uint32) {
+	c.pliMutex.Lock()
+	defer c.pliMutex.Unlock()
 
-	for { // Loop thru the video clips
-		if c.IsClosed() {
-			return
-		}
+	c.videoSSRC = ssrc
+}
 
-		// NOTE: The video clips will not be played back in order since we are just
-		// iterating thru a map.
+// addRecordTrack registers a track with the recording, creating the rtpdump writer on the first call.
+func (c *PeerClient) addRecordTrack(track *webrtc.Track) error {
+	c.recordMutex.Lock()
+	defer c.recordMutex.Unlock()
 
-		for id, buf := range c.services.Videos { //TODO: Note: not thread safe
-			if c.IsClosed() {
-				return
-			}
+	if c.recordWriter == nil {
+		header := rtpdump.Header{
+			Start:  time.Unix(9, 0).UTC(),
+			Source: net.IPv4(2, 2, 2, 2),
+			Port:   2222,
+		}
 
-			log.Printf("Started streaming %s to Client %s...\n", id, c.id)
+		recording, err := c.services.Recordings.Create(c.id)
+		if err != nil {
+			return err
+		}
+		c.recordWriter, err = rtpdump.NewWriter(recording, header)
+		if err != nil {
+			recording.Abort()
+			return err
+		}
+		c.recording = recording
+	}
 
-			r, _, err := rtpdump.NewReader(bytes.NewReader(buf.Bytes()))
-			if err != nil {
-				log.Println(err)
-				return
-			}
+	c.recordTracks = append(c.recordTracks, RecordingTrack{
+		Kind:        track.Kind().String(),
+		Codec:       track.Codec().Name,
+		PayloadType: track.PayloadType(),
+		ClockRate:   track.Codec().ClockRate,
+		SSRC:        track.SSRC(),
+	})
+	return nil
+}
 
-			clipreset := true
+// addRecordTrackLoss counts packets lost on a recorded track.
+func (c *PeerClient) addRecordTrackLoss(pt uint8, lost int) {
+	c.recordMutex.Lock()
+	defer c.recordMutex.Unlock()
 
-			for range ticker.C {
-				if c.IsClosed() {
-					return
-				}
+	for i := range c.recordTracks {
+		if c.recordTracks[i].PayloadType == pt {
+			c.recordTracks[i].PacketsLost += lost
+		}
+	}
+}
 
-				pkt, err := r.Next()
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					log.Println(err)
-					return
-				}
+// writeRecordPacket appends a packet to the recording. The packet offset is its capture time
+// relative to the first packet recorded in the session. Safe to call from each track's record loop.
+func (c *PeerClient) writeRecordPacket(raw []byte, captured time.Time) error {
+	c.recordMutex.Lock()
+	defer c.recordMutex.Unlock()
 
-				rtp.Unmarshal(pkt.Payload)
-
-				// ---
-				// NOTE: You can alter the packets here for testing.
-				// ---
-				//
-				// For example: Decoding the frame header to save i-frames as png files...
-				//
-				// if fh, err := c.decodeVP8FrameHeader(&rtp); err == nil && fh.KeyFrame {
-				// 	log.Printf("[KEYFRAME] %s\n", VP8FrameHeaderToString(fh))
-				// 	if img, err := c.decoder.DecodeFrame(); err == nil {
-				// 		log.Println("*** FRAME DECODED OK ***")
-				// 		if err = SaveAsPNG(img, fmt.Sprintf("%s_%d.png", c.id, seq)); err != nil {
-				// 			log.Printf("Unable to save PNG: %s\n", err)
-				// 		}
-				// 	} else {
-				// 		log.Printf("Unable to decode the rest of the keyframe: %s\n", err)
-				// 	}
-				// }
-
-				rtp.SSRC = outputTrack.SSRC()
-
-				// Work around for playback in safari, specifically for h264.
-				// https://github.com/pion/webrtc/issues/716
-				rtp.PayloadType = c.pt
-
-				// Adjust the timestamp and sequence for streaming
-				if clipreset {
-					clipreset = false
-					tsdelta = 0
-				} else {
-					tsdelta = rtp.Timestamp - tsprev
-				}
-				tsprev = rtp.Timestamp
+	if c.recordStart.IsZero() {
+		c.recordStart = captured
+	}
+	offset := captured.Sub(c.recordStart)
+	if offset < 0 {
+		offset = 0
+	}
 
-				if tsbegin == 0 {
-					tsbegin = 1
-					tsmod = tsbegin
-				} else {
-					tsmod = tsmod + tsdelta
-				}
-				rtp.SequenceNumber = seq
-				seq++
-				rtp.Timestamp = tsmod
+	return c.recordWriter.WritePacket(rtpdump.Packet{
+		Offset:  offset,
+		IsRTCP:  false,
+		Payload: raw,
+	})
+}
 
-				err = outputTrack.WriteRTP(&rtp)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-			}
-			log.Printf("Finished streaming %s to Client %s...\n", id, c.id)
-		}
+// writeMessage sends a signal message. The websocket only supports one writer at a time.
+func (c *PeerClient) writeMessage(msg *SignalMessage) error {
+	// HTTP clients have no signal socket to send messages on
+	if c.ws == nil {
+		return nil
 	}
+
+	c.wsMutex.Lock()
+	defer c.wsMutex.Unlock()
+
+	return c.ws.WriteJSON(msg)
 }
 
 func (c *PeerClient) sendError(errMsg string) error {
@@ -428,7 +843,7 @@ func (c *PeerClient) sendError(errMsg string) error {
 	msg.Data = errMsg
 	msg.Marshal()
 
-	err := c.ws.WriteJSON(&msg)
+	err := c.writeMessage(&msg)
 	if err != nil {
 		return err
 	}
@@ -436,12 +851,14 @@ func (c *PeerClient) sendError(errMsg string) error {
 	return nil
 }
 
+// decodeVP8FrameHeader decodes the frame header of a VP8 packet that starts a frame.
 func (c *PeerClient) decodeVP8FrameHeader(pkt *rtp.Packet) (*vp8.FrameHeader, error) {
 	// https://tools.ietf.org/html/rfc6386
 
-	const offset = 4 //TODO: Location of the beginning of the vp8 packet inside the rtp payload.
-
-	b := append(pkt.Payload[offset:], pkt.Payload[offset:]...)
+	b, ok := vp8FrameStart(pkt.Payload)
+	if !ok {
+		return nil, errors.New("packet does not start a vp8 frame")
+	}
 
 	rdr := bytes.NewBuffer(b)
 
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v2"
+	"github.com/pion/webrtc/v2"
+)
+
+// supportedVideoCodecs lists the video codecs that can be negotiated with a client.
+var supportedVideoCodecs = []string{webrtc.H264, webrtc.VP8, webrtc.VP9}
+
+// videoRTCPFeedback is the RTCP feedback negotiated for the video codecs. Browsers only answer
+// NACKs with retransmissions, and only send them, when nack is in the session description.
+var videoRTCPFeedback = []webrtc.RTCPFeedback{
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+}
+
+// newVideoCodec creates the rtp codec for a video codec name.
+func newVideoCodec(name string) (*webrtc.RTPCodec, error) {
+	var codec *webrtc.RTPCodec
+
+	switch strings.ToUpper(name) {
+	case webrtc.H264:
+		codec = webrtc.NewRTPH264Codec(webrtc.DefaultPayloadTypeH264, videoClockRate)
+	case webrtc.VP8:
+		codec = webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, videoClockRate)
+	case webrtc.VP9:
+		// pion does not ship a VP9 payloader and refuses to create tracks without one
+		// ("codec payloader not set"), so we provide our own.
+		codec = webrtc.NewRTPVP9Codec(webrtc.DefaultPayloadTypeVP9, videoClockRate)
+		codec.Payloader = &vp9Payloader{}
+	default:
+		return nil, fmt.Errorf("unsupported or unrecognized video codec: %s", name)
+	}
+
+	codec.RTCPFeedback = videoRTCPFeedback
+	return codec, nil
+}
+
+// videoCodecPreference orders the supported video codecs with the preferred codec first.
+func videoCodecPreference(preferred string) ([]string, error) {
+	if _, err := newVideoCodec(preferred); err != nil {
+		return nil, err
+	}
+
+	codecs := []string{strings.ToUpper(preferred)}
+	for _, name := range supportedVideoCodecs {
+		if name != codecs[0] {
+			codecs = append(codecs, name)
+		}
+	}
+	return codecs, nil
+}
+
+// offeredVideoCodecs returns the names of the video codecs in a browser offer in the browser's order of preference.
+func offeredVideoCodecs(sd *sdp.SessionDescription) []string {
+	codecs := []string{}
+	seen := map[string]bool{}
+
+	for _, media := range sd.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			pt, err := strconv.ParseUint(format, 10, 8)
+			if err != nil {
+				continue
+			}
+			codec, err := sd.GetCodecForPayloadType(uint8(pt))
+			if err != nil {
+				continue
+			}
+			name := strings.ToUpper(codec.Name)
+			if !seen[name] {
+				seen[name] = true
+				codecs = append(codecs, name)
+			}
+		}
+	}
+	return codecs
+}
+
+func containsCodec(codecs []string, name string) bool {
+	for _, c := range codecs {
+		if strings.EqualFold(c, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordingCodec picks the video codec to record a client with. The configured codec is used when
+// the browser offers it, otherwise the first supported codec in the browser's offer.
+func (svc *WebRTCService) RecordingCodec(offered []string) (string, error) {
+	if containsCodec(offered, svc.videoCodecs[0]) {
+		return svc.videoCodecs[0], nil
+	}
+	for _, name := range offered {
+		if containsCodec(svc.videoCodecs, name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("none of the offered video codecs (%s) are supported", strings.Join(offered, ", "))
+}
+
+// PlaybackCodec picks the video codec to play the given recordings back with for a principal.
+// Recordings are streamed as they were recorded, so the browser must be able to decode their codec
+// and every clip in a playlist must share it. Without a playlist the configured codec is preferred
+// if the browser offers it and the principal may play recordings in it.
+func (svc *WebRTCService) PlaybackCodec(p *Principal, ids []string, offered []string) (string, error) {
+	if len(ids) > 0 {
+		codec := ""
+		for _, id := range ids {
+			rec, err := svc.Recordings.Get(id)
+			if err != nil || !p.CanRead(rec) {
+				return "", fmt.Errorf("unknown recording id %s", id)
+			}
+			name := rec.VideoCodec()
+			if name == "" {
+				continue
+			}
+			if codec != "" && !strings.EqualFold(codec, name) {
+				return "", fmt.Errorf("recordings %s use different video codecs and cannot be played back in one stream", strings.Join(ids, ", "))
+			}
+			codec = name
+		}
+		if codec == "" {
+			return svc.RecordingCodec(offered)
+		}
+		if !containsCodec(offered, codec) {
+			return "", fmt.Errorf("your browser cannot play %s video. Please use a browser that supports %s", codec, codec)
+		}
+		return strings.ToUpper(codec), nil
+	}
+
+	hasVideo := false
+	recs := svc.ReadableRecordings(p)
+	for _, name := range svc.videoCodecs {
+		for _, rec := range recs {
+			if !strings.EqualFold(rec.VideoCodec(), name) {
+				continue
+			}
+			hasVideo = true
+			if containsCodec(offered, name) {
+				return name, nil
+			}
+		}
+	}
+	if !hasVideo {
+		// Only audio has been recorded, so any codec the browser supports will do
+		return svc.RecordingCodec(offered)
+	}
+	return "", fmt.Errorf("your browser cannot play any of the recorded video codecs")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+)
+
+func TestNewVideoCodecNegotiatesNACK(t *testing.T) {
+	for _, name := range supportedVideoCodecs {
+		codec, err := newVideoCodec(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		feedback := map[webrtc.RTCPFeedback]bool{}
+		for _, f := range codec.RTCPFeedback {
+			feedback[f] = true
+		}
+		for _, want := range []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}} {
+			if !feedback[want] {
+				t.Errorf("%s: rtcp feedback %+v not negotiated, got %+v", name, want, codec.RTCPFeedback)
+			}
+		}
+	}
+}
+
+func TestNewVideoCodecUnsupported(t *testing.T) {
+	if _, err := newVideoCodec("AV1"); err == nil {
+		t.Error("expected an error for an unsupported codec")
+	}
+}
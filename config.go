@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// ICEServerConfig describes a STUN or TURN server.
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Config holds the media server settings. Settings are read from an optional JSON file
+// and can be overridden individually with command-line flags.
+type Config struct {
+	Port       int    `json:"port"`
+	VideoCodec string `json:"videoCodec"`
+	Store      string `json:"store"`
+
+	ICEServers []ICEServerConfig `json:"iceServers"`
+
+	// ICETransportPolicy restricts the candidates used to connect ("all" or "relay").
+	ICETransportPolicy string `json:"iceTransportPolicy"`
+
+	// NetworkTypes restricts the candidates gathered to the given network types ("udp4", "udp6").
+	NetworkTypes []string `json:"networkTypes"`
+
+	// Range of UDP ports used for peer connections. Any port is used when zero.
+	UDPPortMin uint16 `json:"udpPortMin"`
+	UDPPortMax uint16 `json:"udpPortMax"`
+
+	// Public IPs advertised for the local addresses when running behind a 1:1 NAT
+	// (e.g. inside a container or on a cloud instance). Each entry is either a public IP, used for
+	// every local address of the same family, or a "public/private" pair.
+	NAT1To1IPs []string `json:"nat1To1IPs"`
+
+	// NAT1To1CandidateType is the candidate type the NAT 1:1 IPs are advertised as ("host" or "srflx").
+	NAT1To1CandidateType string `json:"nat1To1CandidateType"`
+
+	// Auth configures the tokens callers must present. Everything is open when not set.
+	Auth AuthConfig `json:"auth"`
+}
+
+// DefaultConfig returns the settings used when no config file or flags are given.
+func DefaultConfig() Config {
+	return Config{
+		Port:       8082,
+		VideoCodec: "H264",
+		ICEServers: []ICEServerConfig{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+		ICETransportPolicy:   "all",
+		NAT1To1CandidateType: "host",
+	}
+}
+
+// iceServerURLs returns the urls of all the configured ICE servers.
+func (cfg *Config) iceServerURLs() []string {
+	urls := []string{}
+	for _, server := range cfg.ICEServers {
+		urls = append(urls, server.URLs...)
+	}
+	return urls
+}
+
+// LoadConfig reads a JSON config file over the default settings.
+func LoadConfig(fn string) (Config, error) {
+	cfg := DefaultConfig()
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %s", fn, err)
+	}
+	return cfg, nil
+}
+
+// WebRTCConfiguration returns the peer connection configuration.
+func (cfg *Config) WebRTCConfiguration() (webrtc.Configuration, error) {
+	config := webrtc.Configuration{}
+
+	for _, server := range cfg.ICEServers {
+		s := webrtc.ICEServer{URLs: server.URLs}
+		if server.Username != "" || server.Credential != "" {
+			s.Username = server.Username
+			s.Credential = server.Credential
+			s.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		config.ICEServers = append(config.ICEServers, s)
+	}
+
+	switch strings.ToLower(cfg.ICETransportPolicy) {
+	case "", "all":
+		config.ICETransportPolicy = webrtc.ICETransportPolicyAll
+	case "relay":
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	default:
+		return config, fmt.Errorf("unsupported ice transport policy: %s", cfg.ICETransportPolicy)
+	}
+
+	return config, nil
+}
+
+// networkTypes maps the network type names accepted in the config to the webrtc network types.
+// Only UDP candidates are gathered by this version of webrtc.
+var networkTypes = map[string]webrtc.NetworkType{
+	"udp4": webrtc.NetworkTypeUDP4,
+	"udp6": webrtc.NetworkTypeUDP6,
+}
+
+// SettingEngine returns the webrtc setting engine for the port range and network filtering.
+func (cfg *Config) SettingEngine() (webrtc.SettingEngine, error) {
+	s := webrtc.SettingEngine{}
+
+	if cfg.UDPPortMin != 0 || cfg.UDPPortMax != 0 {
+		err := s.SetEphemeralUDPPortRange(cfg.UDPPortMin, cfg.UDPPortMax)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	if len(cfg.NetworkTypes) > 0 {
+		types := []webrtc.NetworkType{}
+		for _, raw := range cfg.NetworkTypes {
+			networkType, ok := networkTypes[strings.ToLower(raw)]
+			if !ok {
+				return s, fmt.Errorf("unsupported network type: %s", raw)
+			}
+			types = append(types, networkType)
+		}
+		s.SetNetworkTypes(types)
+	}
+
+	return s, nil
+}
+
+// NATMapping returns the mapping of the local addresses to the NAT 1:1 public IPs.
+// It is nil when no public IPs are configured.
+func (cfg *Config) NATMapping() (*NATMapping, error) {
+	if len(cfg.NAT1To1IPs) == 0 {
+		return nil, nil
+	}
+	return CreateNewNATMapping(cfg.NAT1To1IPs, cfg.NAT1To1CandidateType)
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(v string) []string {
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
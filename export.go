@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media/rtpdump"
+)
+
+// Export formats supported by ExportRecording.
+const (
+	ExportIVF  = "ivf"
+	ExportH264 = "h264"
+	ExportOgg  = "ogg"
+	ExportWebM = "webm"
+)
+
+var (
+	errNoKeyFrame = errors.New("recording contains no decodable key frame")
+	errNoAudio    = errors.New("recording contains no audio")
+)
+
+// exportContentTypes maps each export format to the content type it is served with.
+var exportContentTypes = map[string]string{
+	ExportIVF:  "video/x-ivf",
+	ExportH264: "video/h264",
+	ExportOgg:  "audio/ogg",
+	ExportWebM: "video/webm",
+}
+
+// DefaultExportFormat returns the export format best suited to the recording's video codec.
+func DefaultExportFormat(rec *Recording) string {
+	if strings.ToUpper(rec.VideoCodec()) == webrtc.H264 {
+		return ExportH264
+	}
+	return ExportIVF
+}
+
+// ExportRecording depacketizes a recording read from r and writes it to w as an IVF file (VP8, VP9),
+// an Annex-B H264 elementary stream, an Ogg/Opus file (audio only) or a WebM file (VP8 or VP9 and Opus).
+func ExportRecording(rec *Recording, r io.Reader, format string, w io.Writer) error {
+	codec := strings.ToUpper(rec.VideoCodec())
+
+	switch format {
+	case ExportOgg:
+		return exportOgg(rec, r, w)
+	case ExportWebM:
+		if codec != "" && codec != webrtc.VP8 && codec != webrtc.VP9 {
+			return fmt.Errorf("cannot export %s video as %s", codec, format)
+		}
+		return exportWebM(rec, r, w)
+	}
+
+	var push func(pkt *rtp.Packet) error
+	var done func() error
+
+	switch format {
+	case ExportIVF:
+		if codec != "" && codec != webrtc.VP8 && codec != webrtc.VP9 {
+			return fmt.Errorf("cannot export %s video as %s", codec, format)
+		}
+		var iw *ivfWriter
+		var d videoDepacketizer
+		if codec == webrtc.VP9 {
+			iw = newIVFWriter(w, "VP90", rec.Width, rec.Height)
+			d = newVP9Depacketizer(iw.writeVP9Frame)
+		} else {
+			iw = newIVFWriter(w, "VP80", rec.Width, rec.Height)
+			d = newVP8Depacketizer(iw.writeVP8Frame)
+		}
+		push = d.push
+		done = func() error {
+			if err := d.flush(); err != nil {
+				return err
+			}
+			if !iw.headerWritten {
+				return errNoKeyFrame
+			}
+			return nil
+		}
+
+	case ExportH264:
+		if codec != "" && codec != webrtc.H264 {
+			return fmt.Errorf("cannot export %s video as %s", codec, format)
+		}
+		aw := annexBWriter{w: w}
+		d := newH264Depacketizer(aw.writeNALU)
+		push = d.push
+		done = func() error {
+			if !aw.started {
+				return errNoKeyFrame
+			}
+			return nil
+		}
+
+	default:
+		return fmt.Errorf("unsupported export format %s", format)
+	}
+
+	err := forEachTrackPacket(rec, r, webrtc.RTPCodecTypeVideo, push)
+	if err != nil {
+		return err
+	}
+	return done()
+}
+
+// exportOgg writes the Opus audio track of a recording as an Ogg file.
+func exportOgg(rec *Recording, r io.Reader, w io.Writer) error {
+	ow := newOggOpusWriter(w, rand.Uint32())
+
+	err := forEachTrackPacket(rec, r, webrtc.RTPCodecTypeAudio, func(pkt *rtp.Packet) error {
+		return ow.writePacket(pkt.Payload, pkt.Timestamp)
+	})
+	if err != nil {
+		return err
+	}
+	if !ow.headerWritten {
+		return errNoAudio
+	}
+	return ow.Close()
+}
+
+// exportWebM muxes the VP8 or VP9 video and Opus audio tracks of a recording into a WebM file. Both
+// tracks are placed on the capture timeline using the same clock mapping as playback.
+func exportWebM(rec *Recording, r io.Reader, w io.Writer) error {
+	m := newWebMMuxer(w, rec)
+
+	videoClock := trackClock{clockRate: videoClockRate}
+	audioClock := trackClock{clockRate: audioClockRate}
+	frameTimes := map[uint32]time.Duration{}
+
+	onFrame := func(frame []byte, ts uint32) error {
+		return m.addVideoFrame(frame, frameTimes[ts])
+	}
+
+	var d videoDepacketizer
+	if m.codec == webrtc.VP9 {
+		d = newVP9Depacketizer(onFrame)
+	} else {
+		d = newVP8Depacketizer(onFrame)
+	}
+
+	err := forEachPacket(rec, r, func(pkt *rtp.Packet, kind string, offset time.Duration) error {
+		if kind == webrtc.RTPCodecTypeAudio.String() {
+			return m.addAudioPacket(pkt.Payload, audioClock.due(pkt.Timestamp, offset))
+		}
+		if _, ok := frameTimes[pkt.Timestamp]; !ok {
+			frameTimes[pkt.Timestamp] = videoClock.due(pkt.Timestamp, offset)
+		}
+		err := d.push(pkt)
+
+		// The depacketizer only holds the frame of the latest timestamp, so earlier frames
+		// have been emitted or dropped by now
+		for ts := range frameTimes {
+			if ts != pkt.Timestamp {
+				delete(frameTimes, ts)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = d.flush(); err != nil {
+		return err
+	}
+	return m.Close()
+}
+
+// videoDepacketizer reassembles video frames from RTP packets.
+type videoDepacketizer interface {
+	push(pkt *rtp.Packet) error
+	flush() error
+}
+
+// forEachPacket calls fn for every RTP packet in a recording's rtpdump stream along with the kind
+// of track it belongs to and its capture offset. Recordings without track information are
+// assumed to contain only video.
+func forEachPacket(rec *Recording, r io.Reader, fn func(pkt *rtp.Packet, kind string, offset time.Duration) error) error {
+	dr, _, err := rtpdump.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		dpkt, err := dr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if dpkt.IsRTCP {
+			continue
+		}
+
+		pkt := &rtp.Packet{}
+		if err = pkt.Unmarshal(dpkt.Payload); err != nil {
+			continue
+		}
+
+		kind := webrtc.RTPCodecTypeVideo.String()
+		if t := rec.Track(pkt.PayloadType); t != nil {
+			kind = t.Kind
+		}
+
+		if err = fn(pkt, kind, dpkt.Offset); err != nil {
+			return err
+		}
+	}
+}
+
+// forEachTrackPacket calls fn for every packet of the given kind in a recording's rtpdump stream.
+func forEachTrackPacket(rec *Recording, r io.Reader, kind webrtc.RTPCodecType, fn func(pkt *rtp.Packet) error) error {
+	return forEachPacket(rec, r, func(pkt *rtp.Packet, pktKind string, offset time.Duration) error {
+		if pktKind != kind.String() {
+			return nil
+		}
+		return fn(pkt)
+	})
+}
+
+// ivfWriter writes video frames into an IVF container using a 90kHz timebase.
+// https://wiki.multimedia.cx/index.php/IVF
+type ivfWriter struct {
+	w             io.Writer
+	fourcc        string
+	width, height int
+
+	headerWritten bool
+	keyFrameSeen  bool
+	firstTs       uint32
+	prevTs        uint32
+	pts           uint64
+}
+
+func newIVFWriter(w io.Writer, fourcc string, width, height int) *ivfWriter {
+	return &ivfWriter{w: w, fourcc: fourcc, width: width, height: height}
+}
+
+func (iw *ivfWriter) writeHeader() error {
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)  // version
+	binary.LittleEndian.PutUint16(header[6:], 32) // header size
+	copy(header[8:], iw.fourcc)
+	binary.LittleEndian.PutUint16(header[12:], uint16(iw.width))
+	binary.LittleEndian.PutUint16(header[14:], uint16(iw.height))
+	binary.LittleEndian.PutUint32(header[16:], videoClockRate) // timebase denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)              // timebase numerator
+	binary.LittleEndian.PutUint32(header[24:], 0)              // frame count, unknown when streaming
+
+	_, err := iw.w.Write(header)
+	return err
+}
+
+// writeFrame writes a single frame. Frames before the first key frame are dropped.
+func (iw *ivfWriter) writeFrame(frame []byte, ts uint32, keyFrame bool) error {
+	if !iw.keyFrameSeen {
+		if !keyFrame {
+			return nil
+		}
+		iw.keyFrameSeen = true
+		iw.prevTs = ts
+	}
+
+	if !iw.headerWritten {
+		if err := iw.writeHeader(); err != nil {
+			return err
+		}
+		iw.headerWritten = true
+	}
+
+	if delta := int32(ts - iw.prevTs); delta > 0 {
+		iw.pts += uint64(delta)
+	}
+	iw.prevTs = ts
+
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], iw.pts)
+
+	if _, err := iw.w.Write(header); err != nil {
+		return err
+	}
+	_, err := iw.w.Write(frame)
+	return err
+}
+
+// writeVP8Frame writes a VP8 frame, taking the dimensions from the first key frame.
+func (iw *ivfWriter) writeVP8Frame(frame []byte, ts uint32) error {
+	keyFrame := vp8IsKeyFrame(frame)
+	if keyFrame && !iw.headerWritten {
+		if w, h, ok := vp8KeyFrameSize(frame); ok {
+			iw.width, iw.height = w, h
+		}
+	}
+	return iw.writeFrame(frame, ts, keyFrame)
+}
+
+// writeVP9Frame writes a VP9 frame or superframe, taking the dimensions from the first key frame.
+func (iw *ivfWriter) writeVP9Frame(frame []byte, ts uint32) error {
+	keyFrame := vp9IsKeyFrame(frame)
+	if keyFrame && !iw.headerWritten {
+		if w, h, ok := vp9KeyFrameSize(frame); ok {
+			iw.width, iw.height = w, h
+		}
+	}
+	return iw.writeFrame(frame, ts, keyFrame)
+}
+
+// annexBWriter writes H264 NAL units as an Annex-B byte stream. Output starts at the
+// first SPS or IDR so the stream can be decoded from the beginning.
+type annexBWriter struct {
+	w       io.Writer
+	started bool
+}
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+func (aw *annexBWriter) writeNALU(nalu []byte, ts uint32) error {
+	if len(nalu) == 0 {
+		return nil
+	}
+	if !aw.started {
+		t := nalu[0] & h264NALUTypeMask
+		if t != h264NALUTypeSPS && t != h264NALUTypeIDR {
+			return nil
+		}
+		aw.started = true
+	}
+
+	if _, err := aw.w.Write(annexBStartCode); err != nil {
+		return err
+	}
+	_, err := aw.w.Write(nalu)
+	return err
+}
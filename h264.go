@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/pion/rtp"
+)
+
+// H264 NAL unit types used when working with RTP payloads.
+// https://tools.ietf.org/html/rfc6184
+const (
+	h264NALUTypeIDR   = 5
+	h264NALUTypeSPS   = 7
+	h264NALUTypePPS   = 8
+	h264NALUTypeSTAPA = 24
+	h264NALUTypeFUA   = 28
+
+	h264NALUTypeMask = 0x1f
+)
+
+var errShortH264SPS = errors.New("h264 sps too short")
+
+// h264NALUs returns the complete NAL units carried by a single NAL unit or STAP-A packet.
+// Fragmented (FU-A) NAL units are not returned.
+func h264NALUs(payload []byte) [][]byte {
+	if len(payload) < 1 {
+		return nil
+	}
+
+	switch payload[0] & h264NALUTypeMask {
+	case h264NALUTypeSTAPA:
+		nalus := [][]byte{}
+		for i := 1; i+2 <= len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if size == 0 || i+size > len(payload) {
+				break
+			}
+			nalus = append(nalus, payload[i:i+size])
+			i += size
+		}
+		return nalus
+	case h264NALUTypeFUA:
+		return nil
+	default:
+		return [][]byte{payload}
+	}
+}
+
+// h264IsKeyFrame reports whether the packet starts a key frame: it carries a sequence parameter
+// set or the start of an IDR slice.
+func h264IsKeyFrame(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	if payload[0]&h264NALUTypeMask == h264NALUTypeFUA {
+		return payload[1]&0x80 != 0 && payload[1]&h264NALUTypeMask == h264NALUTypeIDR
+	}
+	for _, nalu := range h264NALUs(payload) {
+		if t := nalu[0] & h264NALUTypeMask; t == h264NALUTypeSPS || t == h264NALUTypeIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// h264BitReader reads the bits of an RBSP, most significant bit first.
+type h264BitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *h264BitReader) bit() (uint, error) {
+	if r.pos >= len(r.b)*8 {
+		return 0, errShortH264SPS
+	}
+	v := uint(r.b[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+	return v, nil
+}
+
+func (r *h264BitReader) bits(n int) (uint, error) {
+	v := uint(0)
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *h264BitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errShortH264SPS
+		}
+	}
+	v, err := r.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1 << uint(zeros)) - 1 + v, nil
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *h264BitReader) se() (int, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 0 {
+		return -int(v / 2), nil
+	}
+	return int(v+1) / 2, nil
+}
+
+// h264RBSP strips the emulation prevention bytes from a NAL unit.
+func h264RBSP(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// h264SPSSize returns the picture dimensions described by a sequence parameter set NAL unit.
+// https://www.itu.int/rec/T-REC-H.264 section 7.3.2.1.1
+func h264SPSSize(nalu []byte) (width, height int, err error) {
+	if len(nalu) < 4 || nalu[0]&h264NALUTypeMask != h264NALUTypeSPS {
+		return 0, 0, errShortH264SPS
+	}
+
+	r := h264BitReader{b: h264RBSP(nalu[1:])}
+
+	profile, err := r.bits(8)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err = r.bits(16); err != nil { // constraint flags, level
+		return 0, 0, err
+	}
+	if _, err = r.ue(); err != nil { // seq_parameter_set_id
+		return 0, 0, err
+	}
+
+	chromaFormat := uint(1)
+	separateColourPlane := uint(0)
+
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat, err = r.ue(); err != nil {
+			return 0, 0, err
+		}
+		if chromaFormat == 3 {
+			if separateColourPlane, err = r.bit(); err != nil {
+				return 0, 0, err
+			}
+		}
+		if _, err = r.ue(); err != nil { // bit_depth_luma_minus8
+			return 0, 0, err
+		}
+		if _, err = r.ue(); err != nil { // bit_depth_chroma_minus8
+			return 0, 0, err
+		}
+		if _, err = r.bit(); err != nil { // qpprime_y_zero_transform_bypass_flag
+			return 0, 0, err
+		}
+		scalingMatrix, err := r.bit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if scalingMatrix == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.bit()
+				if err != nil {
+					return 0, 0, err
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						delta, err := r.se()
+						if err != nil {
+							return 0, 0, err
+						}
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	if _, err = r.ue(); err != nil { // log2_max_frame_num_minus4
+		return 0, 0, err
+	}
+	pocType, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		if _, err = r.ue(); err != nil { // log2_max_pic_order_cnt_lsb_minus4
+			return 0, 0, err
+		}
+	case 1:
+		if _, err = r.bit(); err != nil { // delta_pic_order_always_zero_flag
+			return 0, 0, err
+		}
+		if _, err = r.se(); err != nil { // offset_for_non_ref_pic
+			return 0, 0, err
+		}
+		if _, err = r.se(); err != nil { // offset_for_top_to_bottom_field
+			return 0, 0, err
+		}
+		cycle, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := uint(0); i < cycle; i++ {
+			if _, err = r.se(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	if _, err = r.ue(); err != nil { // max_num_ref_frames
+		return 0, 0, err
+	}
+	if _, err = r.bit(); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return 0, 0, err
+	}
+	widthMbs, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	heightMapUnits, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		if _, err = r.bit(); err != nil { // mb_adaptive_frame_field_flag
+			return 0, 0, err
+		}
+	}
+	if _, err = r.bit(); err != nil { // direct_8x8_inference_flag
+		return 0, 0, err
+	}
+
+	width = int(widthMbs+1) * 16
+	height = int(2-frameMbsOnly) * int(heightMapUnits+1) * 16
+
+	cropping, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping == 1 {
+		crop := [4]uint{}
+		for i := range crop {
+			if crop[i], err = r.ue(); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		cropUnitX, cropUnitY := 1, int(2-frameMbsOnly)
+		if separateColourPlane == 0 {
+			switch chromaFormat {
+			case 1:
+				cropUnitX, cropUnitY = 2, 2*int(2-frameMbsOnly)
+			case 2:
+				cropUnitX = 2
+			}
+		}
+		width -= cropUnitX * int(crop[0]+crop[1])
+		height -= cropUnitY * int(crop[2]+crop[3])
+	}
+
+	return width, height, nil
+}
+
+// h264Depacketizer extracts H264 NAL units from RTP packets, reassembling FU-A fragments
+// and splitting STAP-A aggregates. Fragmented NAL units with missing packets are dropped.
+type h264Depacketizer struct {
+	onNALU func(nalu []byte, ts uint32) error
+
+	fua     []byte
+	seq     uint16
+	started bool
+}
+
+func newH264Depacketizer(onNALU func(nalu []byte, ts uint32) error) *h264Depacketizer {
+	return &h264Depacketizer{onNALU: onNALU}
+}
+
+// push processes a single RTP packet.
+func (d *h264Depacketizer) push(pkt *rtp.Packet) error {
+	payload := pkt.Payload
+	if len(payload) < 1 {
+		return nil
+	}
+
+	if d.started && pkt.SequenceNumber != d.seq+1 {
+		d.fua = nil
+	}
+	d.started = true
+	d.seq = pkt.SequenceNumber
+
+	if payload[0]&h264NALUTypeMask != h264NALUTypeFUA {
+		for _, nalu := range h264NALUs(payload) {
+			if err := d.onNALU(nalu, pkt.Timestamp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(payload) < 2 {
+		return nil
+	}
+	indicator, header := payload[0], payload[1]
+
+	if header&0x80 != 0 { // S: start of the fragmented NAL unit
+		d.fua = []byte{indicator&0xe0 | header&h264NALUTypeMask}
+	} else if d.fua == nil {
+		return nil
+	}
+	d.fua = append(d.fua, payload[2:]...)
+
+	if header&0x40 != 0 { // E: end of the fragmented NAL unit
+		nalu := d.fua
+		d.fua = nil
+		return d.onNALU(nalu, pkt.Timestamp)
+	}
+	return nil
+}
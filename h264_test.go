@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// h264TestBitWriter writes the fields of a test sequence parameter set.
+type h264TestBitWriter struct {
+	b []byte
+	n uint
+}
+
+func (w *h264TestBitWriter) bits(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.b[len(w.b)-1] |= 0x80 >> (w.n % 8)
+		}
+		w.n++
+	}
+}
+
+// ue writes an unsigned exp-Golomb code.
+func (w *h264TestBitWriter) ue(v uint) {
+	length := 0
+	for x := v + 1; x > 1; x >>= 1 {
+		length++
+	}
+	w.bits(0, length)
+	w.bits(v+1, length+1)
+}
+
+// se writes a signed exp-Golomb code.
+func (w *h264TestBitWriter) se(v int) {
+	if v > 0 {
+		w.ue(uint(2*v - 1))
+	} else {
+		w.ue(uint(-2 * v))
+	}
+}
+
+// nalu returns the SPS NAL unit with the trailing bits and emulation prevention bytes.
+func (w *h264TestBitWriter) nalu() []byte {
+	w.bits(1, 1)
+	rbsp := w.b
+
+	nalu := []byte{0x67}
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			nalu = append(nalu, 0x03)
+			zeros = 0
+		}
+		nalu = append(nalu, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return nalu
+}
+
+// h264TestSPS describes the fields of a test sequence parameter set.
+type h264TestSPS struct {
+	profile        uint
+	chromaFormat   uint
+	scalingLists   bool
+	pocType        uint
+	maxRefFrames   uint
+	widthMbs       uint
+	heightMapUnits uint
+	frameMbsOnly   bool
+	crop           []uint // left, right, top, bottom
+}
+
+func (s h264TestSPS) nalu() []byte {
+	w := h264TestBitWriter{}
+	w.bits(s.profile, 8)
+	w.bits(0, 8)  // constraint flags
+	w.bits(31, 8) // level
+	w.ue(0)       // seq_parameter_set_id
+
+	if s.profile == 100 {
+		w.ue(s.chromaFormat)
+		if s.chromaFormat == 3 {
+			w.bits(0, 1) // separate_colour_plane_flag
+		}
+		w.ue(0)      // bit_depth_luma_minus8
+		w.ue(0)      // bit_depth_chroma_minus8
+		w.bits(0, 1) // qpprime_y_zero_transform_bypass_flag
+		if s.scalingLists {
+			w.bits(1, 1)
+			// The first list is present and ends early with a delta back to 0, the rest are not
+			w.bits(1, 1)
+			w.se(8)
+			w.se(-16)
+			w.bits(0, 7)
+		} else {
+			w.bits(0, 1)
+		}
+	}
+
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(s.pocType)
+	switch s.pocType {
+	case 0:
+		w.ue(0) // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		w.bits(0, 1) // delta_pic_order_always_zero_flag
+		w.se(-1)     // offset_for_non_ref_pic
+		w.se(0)      // offset_for_top_to_bottom_field
+		w.ue(2)      // num_ref_frames_in_pic_order_cnt_cycle
+		w.se(3)
+		w.se(-3)
+	}
+
+	w.ue(s.maxRefFrames)
+	w.bits(0, 1) // gaps_in_frame_num_value_allowed_flag
+	w.ue(s.widthMbs - 1)
+	w.ue(s.heightMapUnits - 1)
+	if s.frameMbsOnly {
+		w.bits(1, 1)
+	} else {
+		w.bits(0, 1)
+		w.bits(0, 1) // mb_adaptive_frame_field_flag
+	}
+	w.bits(1, 1) // direct_8x8_inference_flag
+
+	if len(s.crop) == 4 {
+		w.bits(1, 1)
+		for _, c := range s.crop {
+			w.ue(c)
+		}
+	} else {
+		w.bits(0, 1)
+	}
+	w.bits(0, 1) // vui_parameters_present_flag
+	return w.nalu()
+}
+
+func TestH264SPSSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		sps           h264TestSPS
+		width, height int
+	}{
+		{
+			name:   "baseline",
+			sps:    h264TestSPS{profile: 66, maxRefFrames: 1, widthMbs: 40, heightMapUnits: 30, frameMbsOnly: true},
+			width:  640,
+			height: 480,
+		},
+		{
+			name:   "high with cropping",
+			sps:    h264TestSPS{profile: 100, chromaFormat: 1, maxRefFrames: 4, widthMbs: 120, heightMapUnits: 68, frameMbsOnly: true, crop: []uint{0, 0, 0, 4}},
+			width:  1920,
+			height: 1080,
+		},
+		{
+			name:   "interlaced with cropping",
+			sps:    h264TestSPS{profile: 100, chromaFormat: 1, maxRefFrames: 4, widthMbs: 120, heightMapUnits: 34, crop: []uint{0, 0, 0, 2}},
+			width:  1920,
+			height: 1080,
+		},
+		{
+			name:   "4:4:4 with cropping",
+			sps:    h264TestSPS{profile: 100, chromaFormat: 3, maxRefFrames: 1, widthMbs: 20, heightMapUnits: 15, frameMbsOnly: true, crop: []uint{1, 1, 2, 2}},
+			width:  318,
+			height: 236,
+		},
+		{
+			name:   "scaling lists",
+			sps:    h264TestSPS{profile: 100, chromaFormat: 1, scalingLists: true, maxRefFrames: 1, widthMbs: 80, heightMapUnits: 45, frameMbsOnly: true},
+			width:  1280,
+			height: 720,
+		},
+		{
+			name:   "picture order count type 1",
+			sps:    h264TestSPS{profile: 66, pocType: 1, maxRefFrames: 1, widthMbs: 20, heightMapUnits: 15, frameMbsOnly: true},
+			width:  320,
+			height: 240,
+		},
+		{
+			name:   "emulation prevention",
+			sps:    h264TestSPS{profile: 66, maxRefFrames: 1<<24 - 1, widthMbs: 40, heightMapUnits: 30, frameMbsOnly: true},
+			width:  640,
+			height: 480,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nalu := tt.sps.nalu()
+			if tt.name == "emulation prevention" && !bytes.Contains(nalu, []byte{0, 0, 3}) {
+				t.Fatalf("sps %x has no emulation prevention byte", nalu)
+			}
+
+			width, height, err := h264SPSSize(nalu)
+			if err != nil {
+				t.Fatalf("sps %x: %s", nalu, err)
+			}
+			if width != tt.width || height != tt.height {
+				t.Errorf("got %dx%d, want %dx%d", width, height, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestH264SPSSizeTruncated(t *testing.T) {
+	nalu := h264TestSPS{profile: 66, maxRefFrames: 1, widthMbs: 40, heightMapUnits: 30, frameMbsOnly: true}.nalu()
+	for _, n := range []int{0, 3, 6} {
+		if _, _, err := h264SPSSize(nalu[:n]); err == nil {
+			t.Errorf("no error for an sps truncated to %d bytes", n)
+		}
+	}
+	if _, _, err := h264SPSSize([]byte{0x68, 0, 0, 0}); err == nil {
+		t.Error("no error for a pps")
+	}
+}
+
+func TestH264NALUs(t *testing.T) {
+	sps := []byte{0x67, 0x42}
+	pps := []byte{0x68, 0xce}
+
+	tests := []struct {
+		name     string
+		payload  []byte
+		nalus    [][]byte
+		keyFrame bool
+	}{
+		{"single", []byte{0x41, 0x9a}, [][]byte{{0x41, 0x9a}}, false},
+		{"idr", []byte{0x65, 0x88}, [][]byte{{0x65, 0x88}}, true},
+		{"stap-a", append(append([]byte{0x78, 0, 2}, sps...), append([]byte{0, 2}, pps...)...), [][]byte{sps, pps}, true},
+		{"truncated stap-a", []byte{0x78, 0, 2, 0x67, 0x42, 0, 9, 0x68}, [][]byte{sps}, true},
+		{"fu-a idr start", []byte{0x7c, 0x85, 0x88}, nil, true},
+		{"fu-a idr continuation", []byte{0x7c, 0x05, 0x88}, nil, false},
+		{"fu-a non-idr start", []byte{0x7c, 0x81, 0x9a}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h264NALUs(tt.payload); !reflect.DeepEqual(got, tt.nalus) {
+				t.Errorf("nalus %x, want %x", got, tt.nalus)
+			}
+			if got := h264IsKeyFrame(tt.payload); got != tt.keyFrame {
+				t.Errorf("key frame %v, want %v", got, tt.keyFrame)
+			}
+		})
+	}
+}
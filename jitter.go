@@ -0,0 +1,183 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// jitterBufferLatency is how long a packet is held waiting for the packets before it. Packets
+// that have not arrived by then are considered lost.
+const jitterBufferLatency = 300 * time.Millisecond
+
+// jitterBufferMaxPackets bounds the packets held waiting on a missing packet. Larger jumps in the
+// sequence are treated as the sender restarting its sequence rather than as loss.
+const jitterBufferMaxPackets = 1024
+
+// Missing packets are requested from the sender with a NACK up to maxNACKRequests times,
+// nackRetryInterval apart, while the jitter buffer waits on them.
+const (
+	maxNACKRequests   = 3
+	nackRetryInterval = 100 * time.Millisecond
+)
+
+// nackRequest tracks the NACKs sent for a missing packet.
+type nackRequest struct {
+	sent  time.Time
+	count int
+}
+
+// jitterPacket is a packet held in a jitter buffer.
+type jitterPacket struct {
+	pkt      *rtp.Packet
+	arrival  time.Time
+	captured time.Time // estimated capture time, set when the packet is released
+}
+
+// jitterBuffer reorders the RTP packets of a recorded track by sequence number, allowing for
+// wraparound, and drops duplicates. Packets are released in order along with their capture
+// time, estimated from their RTP timestamps. The buffer has no timer of its own; it is polled
+// as packets arrive and flushed when the track ends.
+type jitterBuffer struct {
+	clockRate uint32
+	packets   map[uint16]jitterPacket
+	started   bool
+	nextSeq   uint16
+
+	// Missing packets that have been requested from the sender
+	nacks map[uint16]nackRequest
+
+	// The capture timeline is anchored on the packet that arrived with the least delay so far
+	tsStarted bool
+	prevTs    uint32
+	extTs     int64
+	anchor    time.Time
+}
+
+func newJitterBuffer(clockRate uint32) *jitterBuffer {
+	if clockRate == 0 {
+		clockRate = videoClockRate
+	}
+	return &jitterBuffer{
+		clockRate: clockRate,
+		packets:   make(map[uint16]jitterPacket),
+		nacks:     make(map[uint16]nackRequest),
+	}
+}
+
+// push adds a packet to the buffer. Returns false if the packet is a duplicate or arrived after
+// the buffer gave up waiting on it.
+func (j *jitterBuffer) push(pkt *rtp.Packet, arrival time.Time) bool {
+	if !j.started {
+		j.started = true
+		j.nextSeq = pkt.SequenceNumber
+	}
+
+	if diff := int16(pkt.SequenceNumber - j.nextSeq); diff < 0 && diff >= -jitterBufferMaxPackets {
+		return false
+	}
+	if _, ok := j.packets[pkt.SequenceNumber]; ok {
+		return false
+	}
+
+	j.packets[pkt.SequenceNumber] = jitterPacket{pkt: pkt, arrival: arrival}
+	return true
+}
+
+// pop releases the packets that are ready, in sequence order. A missing packet is given up on once
+// a later packet has waited jitterBufferLatency or the buffer is full, and the number of packets
+// skipped over is returned as lost.
+func (j *jitterBuffer) pop(now time.Time) (ready []jitterPacket, lost int) {
+	for len(j.packets) > 0 {
+		if p, ok := j.packets[j.nextSeq]; ok {
+			delete(j.packets, j.nextSeq)
+			j.nextSeq++
+			ready = append(ready, j.release(p))
+			continue
+		}
+
+		// Find the next packet after the gap and how long the oldest packet has been waiting
+		next := j.nextSeq
+		var distance uint16 = 0xffff
+		oldest := now
+		for seq, p := range j.packets {
+			if d := seq - j.nextSeq; d < distance {
+				next, distance = seq, d
+			}
+			if p.arrival.Before(oldest) {
+				oldest = p.arrival
+			}
+		}
+
+		if now.Sub(oldest) < jitterBufferLatency && len(j.packets) < jitterBufferMaxPackets {
+			break
+		}
+		if distance <= jitterBufferMaxPackets {
+			lost += int(distance)
+		}
+		j.nextSeq = next
+	}
+
+	// Forget the requests for packets that have been released or given up on
+	for seq := range j.nacks {
+		if int16(seq-j.nextSeq) < 0 {
+			delete(j.nacks, seq)
+		}
+	}
+	return ready, lost
+}
+
+// missing returns the sequence numbers of the packets missing before the latest buffered packet
+// that are due a NACK, and records that they have been requested.
+func (j *jitterBuffer) missing(now time.Time) []uint16 {
+	var span uint16
+	for seq := range j.packets {
+		if d := seq - j.nextSeq; d > span && d <= jitterBufferMaxPackets {
+			span = d
+		}
+	}
+
+	var seqs []uint16
+	for d := uint16(0); d < span; d++ {
+		seq := j.nextSeq + d
+		if _, ok := j.packets[seq]; ok {
+			continue
+		}
+		r := j.nacks[seq]
+		if r.count >= maxNACKRequests || now.Sub(r.sent) < nackRetryInterval {
+			continue
+		}
+		j.nacks[seq] = nackRequest{sent: now, count: r.count + 1}
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+// flush releases every buffered packet in sequence order, skipping over any gaps.
+func (j *jitterBuffer) flush() (ready []jitterPacket, lost int) {
+	return j.pop(time.Now().Add(jitterBufferLatency))
+}
+
+// release sets the capture time of a packet leaving the buffer. The time elapsed since the first
+// packet is taken from the RTP timestamps, which do not suffer from network jitter. The timeline
+// is re-anchored if the timestamps drift away from the wall clock.
+func (j *jitterBuffer) release(p jitterPacket) jitterPacket {
+	ts := p.pkt.Timestamp
+	if !j.tsStarted {
+		j.tsStarted = true
+		j.prevTs = ts
+		j.anchor = p.arrival
+		p.captured = p.arrival
+		return p
+	}
+
+	j.extTs += int64(int32(ts - j.prevTs))
+	j.prevTs = ts
+
+	elapsed := time.Duration(float64(j.extTs) / float64(j.clockRate) * float64(time.Second))
+	if a := p.arrival.Add(-elapsed); a.Before(j.anchor) || a.Sub(j.anchor) > maxClockDrift {
+		j.anchor = a
+	}
+	p.captured = j.anchor.Add(elapsed)
+	return p
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func jitterTestPacket(seq uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * 3000}}
+}
+
+func jitterSeqs(ready []jitterPacket) []uint16 {
+	seqs := []uint16{}
+	for _, p := range ready {
+		seqs = append(seqs, p.pkt.SequenceNumber)
+	}
+	return seqs
+}
+
+// jitterArrival is a packet arriving at an offset from the start of a test.
+type jitterArrival struct {
+	seq uint16
+	at  time.Duration
+}
+
+func TestJitterBufferReorderAndLoss(t *testing.T) {
+	tests := []struct {
+		name     string
+		arrivals []jitterArrival
+		pollAt   time.Duration
+		want     []uint16
+		lost     int
+	}{
+		{
+			name:     "in order",
+			arrivals: []jitterArrival{{1, 0}, {2, 10 * time.Millisecond}, {3, 20 * time.Millisecond}},
+			pollAt:   20 * time.Millisecond,
+			want:     []uint16{1, 2, 3},
+		},
+		{
+			name:     "reordered within the latency",
+			arrivals: []jitterArrival{{1, 0}, {3, 10 * time.Millisecond}, {4, 20 * time.Millisecond}, {2, 250 * time.Millisecond}},
+			pollAt:   250 * time.Millisecond,
+			want:     []uint16{1, 2, 3, 4},
+		},
+		{
+			name:     "sequence wraparound",
+			arrivals: []jitterArrival{{65534, 0}, {0, 10 * time.Millisecond}, {65535, 20 * time.Millisecond}, {1, 30 * time.Millisecond}},
+			pollAt:   30 * time.Millisecond,
+			want:     []uint16{65534, 65535, 0, 1},
+		},
+		{
+			name:     "gap still waited on",
+			arrivals: []jitterArrival{{1, 0}, {3, 10 * time.Millisecond}},
+			pollAt:   300 * time.Millisecond,
+			want:     []uint16{1},
+		},
+		{
+			name:     "gap given up after the latency",
+			arrivals: []jitterArrival{{1, 0}, {3, 10 * time.Millisecond}},
+			pollAt:   310 * time.Millisecond,
+			want:     []uint16{1, 3},
+			lost:     1,
+		},
+		{
+			name:     "several packets lost",
+			arrivals: []jitterArrival{{10, 0}, {14, 10 * time.Millisecond}, {15, 20 * time.Millisecond}},
+			pollAt:   time.Second,
+			want:     []uint16{10, 14, 15},
+			lost:     3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			jb := newJitterBuffer(videoClockRate)
+
+			got := []uint16{}
+			lost := 0
+			for _, a := range tt.arrivals {
+				if !jb.push(jitterTestPacket(a.seq), start.Add(a.at)) {
+					t.Fatalf("packet %d rejected", a.seq)
+				}
+				ready, l := jb.pop(start.Add(a.at))
+				got = append(got, jitterSeqs(ready)...)
+				lost += l
+			}
+			ready, l := jb.pop(start.Add(tt.pollAt))
+			got = append(got, jitterSeqs(ready)...)
+			lost += l
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("released %v, want %v", got, tt.want)
+			}
+			if lost != tt.lost {
+				t.Errorf("lost %d, want %d", lost, tt.lost)
+			}
+		})
+	}
+}
+
+func TestJitterBufferDropsDuplicatesAndLatePackets(t *testing.T) {
+	start := time.Now()
+	jb := newJitterBuffer(videoClockRate)
+
+	jb.push(jitterTestPacket(1), start)
+	jb.push(jitterTestPacket(3), start)
+	if jb.push(jitterTestPacket(3), start) {
+		t.Error("buffered duplicate accepted")
+	}
+
+	jb.pop(start)
+	if jb.push(jitterTestPacket(1), start) {
+		t.Error("released duplicate accepted")
+	}
+
+	// Packet 2 is given up on, so the retransmission arrives too late
+	if _, lost := jb.pop(start.Add(jitterBufferLatency)); lost != 1 {
+		t.Errorf("lost %d, want 1", lost)
+	}
+	if jb.push(jitterTestPacket(2), start.Add(jitterBufferLatency)) {
+		t.Error("packet arriving after it was given up on accepted")
+	}
+}
+
+func TestJitterBufferNACKs(t *testing.T) {
+	start := time.Now()
+	jb := newJitterBuffer(videoClockRate)
+
+	jb.push(jitterTestPacket(1), start)
+	if seqs := jb.missing(start); len(seqs) != 0 {
+		t.Errorf("nothing missing, requested %v", seqs)
+	}
+
+	jb.push(jitterTestPacket(4), start)
+	jb.pop(start)
+
+	steps := []struct {
+		at   time.Duration
+		want []uint16
+	}{
+		{0, []uint16{2, 3}},
+		{50 * time.Millisecond, nil}, // too soon to ask again
+		{100 * time.Millisecond, []uint16{2, 3}},
+		{200 * time.Millisecond, []uint16{2, 3}},
+		{300 * time.Millisecond, nil}, // asked maxNACKRequests times
+	}
+	for _, s := range steps {
+		if got := jb.missing(start.Add(s.at)); !reflect.DeepEqual(got, s.want) {
+			t.Errorf("at %s requested %v, want %v", s.at, got, s.want)
+		}
+	}
+}
+
+func TestJitterBufferRetransmissionFillsGap(t *testing.T) {
+	start := time.Now()
+	jb := newJitterBuffer(videoClockRate)
+
+	jb.push(jitterTestPacket(1), start)
+	jb.push(jitterTestPacket(3), start.Add(10*time.Millisecond))
+	jb.pop(start.Add(10 * time.Millisecond))
+
+	if seqs := jb.missing(start.Add(10 * time.Millisecond)); !reflect.DeepEqual(seqs, []uint16{2}) {
+		t.Fatalf("requested %v, want [2]", seqs)
+	}
+
+	// The retransmission answering the NACK arrives within the jitter buffer latency
+	resent := start.Add(10*time.Millisecond + jitterBufferLatency - time.Millisecond)
+	if !jb.push(jitterTestPacket(2), resent) {
+		t.Fatal("retransmitted packet rejected")
+	}
+
+	ready, lost := jb.pop(resent)
+	if got := jitterSeqs(ready); !reflect.DeepEqual(got, []uint16{2, 3}) {
+		t.Errorf("released %v, want [2 3]", got)
+	}
+	if lost != 0 {
+		t.Errorf("lost %d, want 0", lost)
+	}
+	if seqs := jb.missing(resent.Add(nackRetryInterval)); len(seqs) != 0 {
+		t.Errorf("requested %v after the gap was filled", seqs)
+	}
+
+	// Packets are stored at their capture time, not at the time the retransmission arrived
+	if want := start.Add(100 * time.Millisecond / 3); !ready[0].captured.Equal(want) {
+		t.Errorf("captured at %s, want %s", ready[0].captured.Sub(start), want.Sub(start))
+	}
+}
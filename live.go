@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+// liveViewerQueueSize is the number of packets buffered per live viewer. Packets are dropped
+// for viewers that fall further behind so a slow viewer never stalls the recording.
+const liveViewerQueueSize = 512
+
+var (
+	// ErrLiveSessionNotFound is returned when a live session id is not active.
+	ErrLiveSessionNotFound = errors.New("live session not found")
+
+	// ErrLiveSessionEnded is returned when subscribing to a session that has already ended.
+	ErrLiveSessionEnded = errors.New("live session has ended")
+)
+
+// livePacket is an RTP packet relayed from a recorder to a live viewer.
+type livePacket struct {
+	pkt  *rtp.Packet
+	kind webrtc.RTPCodecType
+}
+
+// LiveSession relays the packets of an in-progress recording to any number of viewers.
+type LiveSession struct {
+	id      string
+	owner   string
+	codec   string
+	started time.Time
+
+	// Asks the publisher for a key frame so new viewers can start decoding
+	requestKeyFrame func(reason string)
+
+	viewers map[string]chan livePacket
+	closed  bool
+
+	mutex sync.Mutex
+}
+
+func newLiveSession(id, owner, codec string, requestKeyFrame func(reason string)) *LiveSession {
+	return &LiveSession{
+		id:              id,
+		owner:           owner,
+		codec:           codec,
+		requestKeyFrame: requestKeyFrame,
+		started:         time.Now(),
+		viewers:         make(map[string]chan livePacket),
+	}
+}
+
+// Subscribe registers a viewer and returns the channel its packets are delivered on.
+// The channel is closed when the session ends.
+func (s *LiveSession) Subscribe(viewerID string) (<-chan livePacket, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, ErrLiveSessionEnded
+	}
+
+	ch := make(chan livePacket, liveViewerQueueSize)
+	s.viewers[viewerID] = ch
+	log.Printf("Client %s is watching live session %s. %d viewers.\n", viewerID, s.id, len(s.viewers))
+
+	if s.requestKeyFrame != nil {
+		go s.requestKeyFrame("live viewer joined")
+	}
+	return ch, nil
+}
+
+// Unsubscribe removes a viewer from the session.
+func (s *LiveSession) Unsubscribe(viewerID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ch, ok := s.viewers[viewerID]; ok {
+		close(ch)
+		delete(s.viewers, viewerID)
+		log.Printf("Client %s stopped watching live session %s.\n", viewerID, s.id)
+	}
+}
+
+// Forward relays a packet to every viewer. Each viewer receives its own copy of the header
+// so it can be rewritten independently.
+func (s *LiveSession) Forward(pkt *rtp.Packet, kind webrtc.RTPCodecType) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, ch := range s.viewers {
+		cp := *pkt
+		select {
+		case ch <- livePacket{pkt: &cp, kind: kind}:
+		default:
+			log.Printf("Client %s is falling behind live session %s. Dropping packet.\n", id, s.id)
+		}
+	}
+}
+
+// Close ends the session and disconnects all viewers.
+func (s *LiveSession) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for id, ch := range s.viewers {
+		close(ch)
+		delete(s.viewers, id)
+	}
+}
+
+// StartLiveSession makes a recording session available for live viewing. Viewers receive the
+// video in the codec it is being recorded with. requestKeyFrame is called when a viewer joins.
+func (svc *WebRTCService) StartLiveSession(id, owner, codec string, requestKeyFrame func(reason string)) *LiveSession {
+	svc.liveMutex.Lock()
+	defer svc.liveMutex.Unlock()
+
+	session := newLiveSession(id, owner, codec, requestKeyFrame)
+	svc.live[id] = session
+	return session
+}
+
+// EndLiveSession ends a live session, disconnecting its viewers.
+func (svc *WebRTCService) EndLiveSession(id string) {
+	svc.liveMutex.Lock()
+	session, ok := svc.live[id]
+	delete(svc.live, id)
+	svc.liveMutex.Unlock()
+
+	if ok {
+		session.Close()
+	}
+}
+
+// LiveSession returns the live session with the given id. An empty id returns the most recently started session.
+func (svc *WebRTCService) LiveSession(id string) (*LiveSession, error) {
+	svc.liveMutex.Lock()
+	defer svc.liveMutex.Unlock()
+
+	if id != "" {
+		session, ok := svc.live[id]
+		if !ok {
+			return nil, ErrLiveSessionNotFound
+		}
+		return session, nil
+	}
+
+	var latest *LiveSession
+	for _, session := range svc.live {
+		if latest == nil || session.started.After(latest.started) {
+			latest = session
+		}
+	}
+	if latest == nil {
+		return nil, ErrLiveSessionNotFound
+	}
+	return latest, nil
+}
+
+// streamLiveToTrack relays a live session's packets to the viewer's video and audio tracks,
+// rewriting the ssrc and payload type and offsetting the sequence numbers and timestamps.
+func (c *PeerClient) streamLiveToTrack(session *LiveSession, video, audio *trackRewriter) {
+	c.wg.Add(1)
+	defer func() {
+		log.Printf("Live track loop exiting client id:%s\n", c.id)
+		c.wg.Done()
+	}()
+
+	ch, err := session.Subscribe(c.id)
+	if err != nil {
+		c.sendError(err.Error())
+		return
+	}
+	defer session.Unsubscribe(c.id)
+
+	// Video is held back until the key frame requested on joining arrives
+	codec := strings.ToUpper(session.codec)
+	waitKeyFrame := true
+
+	for {
+		select {
+		case <-c.closeCh:
+			return
+
+		case lp, ok := <-ch:
+			if !ok {
+				c.sendError("The live session has ended.")
+				return
+			}
+
+			out := video
+			if lp.kind == webrtc.RTPCodecTypeAudio {
+				out = audio
+			} else if waitKeyFrame {
+				if !videoPacketIsKeyFrame(codec, lp.pkt.Payload) {
+					continue
+				}
+				waitKeyFrame = false
+			}
+			err = out.relay(lp.pkt)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -8,47 +9,133 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
-
-	"github.com/pion/webrtc/v2"
+	"time"
 )
 
+// shutdownTimeout is how long clients are given to close and save their recordings on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	var err error
 
-	port := flag.Int("port", 8082, "Endpoint port for the signal server")
-	vcodec := flag.String("vcodec", "H264", "Video Codec (H264, VP8, VP9)")
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err = exportCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	def := DefaultConfig()
+
+	configFile := flag.String("config", "", "JSON config file. Flags override the values it contains.")
+	port := flag.Int("port", def.Port, "Endpoint port for the signal server")
+	vcodec := flag.String("vcodec", def.VideoCodec, "Preferred video codec (H264, VP8, VP9). Clients that do not support it negotiate another.")
+	storeDir := flag.String("store", def.Store, "Directory to persist recordings in. Recordings are kept in memory when not set.")
+	iceServers := flag.String("ice-servers", strings.Join(def.iceServerURLs(), ","), "Comma separated STUN/TURN server urls. Empty for none.")
+	iceUsername := flag.String("ice-username", "", "Username for the TURN servers")
+	iceCredential := flag.String("ice-credential", "", "Credential for the TURN servers")
+	icePolicy := flag.String("ice-transport-policy", def.ICETransportPolicy, "ICE candidates to use (all, relay)")
+	networkTypes := flag.String("network-types", "", "Comma separated network types to gather candidates for (udp4, udp6). All when empty.")
+	udpPortMin := flag.Uint("udp-port-min", 0, "Lowest UDP port used for peer connections")
+	udpPortMax := flag.Uint("udp-port-max", 0, "Highest UDP port used for peer connections")
+	natIPs := flag.String("nat-ips", "", "Comma separated public IPs (public or public/private) to advertise when behind a 1:1 NAT")
+	natCandidateType := flag.String("nat-candidate-type", def.NAT1To1CandidateType, "Candidate type the NAT IPs are advertised as (host, srflx)")
+	jwtSecret := flag.String("jwt-secret", "", "Secret verifying the HS256 signed JWTs callers authenticate with. API keys can be set in the config file.")
 	flag.Parse()
 
-	log.Println("Media Server starting up.")
+	cfg := def
+	if *configFile != "" {
+		cfg, err = LoadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	var videoCodec *webrtc.RTPCodec
+	// Flags given on the command line take precedence over the config file
+	iceCredentialsSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "vcodec":
+			cfg.VideoCodec = *vcodec
+		case "store":
+			cfg.Store = *storeDir
+		case "ice-servers":
+			cfg.ICEServers = nil
+			if urls := splitList(*iceServers); len(urls) > 0 {
+				cfg.ICEServers = []ICEServerConfig{{URLs: urls}}
+			}
+		case "ice-username", "ice-credential":
+			iceCredentialsSet = true
+		case "ice-transport-policy":
+			cfg.ICETransportPolicy = *icePolicy
+		case "network-types":
+			cfg.NetworkTypes = splitList(*networkTypes)
+		case "udp-port-min":
+			cfg.UDPPortMin = uint16(*udpPortMin)
+		case "udp-port-max":
+			cfg.UDPPortMax = uint16(*udpPortMax)
+		case "nat-ips":
+			cfg.NAT1To1IPs = splitList(*natIPs)
+		case "nat-candidate-type":
+			cfg.NAT1To1CandidateType = *natCandidateType
+		case "jwt-secret":
+			cfg.Auth.JWTSecret = *jwtSecret
+		}
+	})
 
-	switch strings.ToUpper(*vcodec) {
-	case "H264":
-		videoCodec = webrtc.NewRTPH264Codec(webrtc.DefaultPayloadTypeH264, 90000)
-	case "VP8":
-		videoCodec = webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000)
+	// The credential flags apply to the servers given by -ice-servers or the config file
+	if iceCredentialsSet {
+		for i := range cfg.ICEServers {
+			cfg.ICEServers[i].Username = *iceUsername
+			cfg.ICEServers[i].Credential = *iceCredential
+		}
+	}
 
-	//TODO: Issues when running with vp8 (Payload type 98. Getting error: codec payloader not set)
-	//case "VP9":
-	//	videoCodec = webrtc.NewRTPVP9Codec(webrtc.DefaultPayloadTypeVP9, 90000)
+	log.Println("Media Server starting up.")
 
-	default:
-		log.Fatal(fmt.Errorf("unsupported or unrecognized video codec: %s", *vcodec))
-		return
+	var store RecordingStore
+	if cfg.Store == "" {
+		store = CreateNewMemoryRecordingStore()
+	} else {
+		store, err = CreateNewFileRecordingStore(cfg.Store)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	services, err := CreateNewWebRTCService(videoCodec)
+	services, err := CreateNewWebRTCService(store, &cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	_, err = CreateNewSignalServer(fmt.Sprintf(":%d", *port), services)
+	auth := CreateNewAuthenticator(cfg.Auth)
+	if !auth.Enabled() {
+		log.Println("No API keys or JWT secret configured. Anyone who can reach the server can use it.")
+	}
+
+	server, err := CreateNewSignalServer(fmt.Sprintf(":%d", cfg.Port), services, auth)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT)
-	<-sig
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s. Media Server shutting down.\n", <-sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Signal server shutdown error: %s\n", err)
+	}
+
+	err = store.Close()
+	if err != nil {
+		log.Printf("Recording store shutdown error: %s\n", err)
+	}
+
+	log.Println("Media Server stopped.")
 }
@@ -28,6 +28,13 @@ var signalMessageOps = [...]string{
 	"ANSWER",
 	"PLAY",
 	"ERROR",
+	"LIVE",
+	"CANDIDATE",
+	"SHUTDOWN",
+	"SEEK",
+	"PAUSE",
+	"RESUME",
+	"RATE",
 }
 
 const (
@@ -37,14 +44,39 @@ const (
 	// SmRecord - browser client sends local browser session description to server and server initiates recording
 	SmRecord
 
-	// SmAnswer - server responds with remote peer description
+	// SmAnswer - server responds with remote peer description. Recording clients also receive
+	// their recording id in the ids field.
 	SmAnswer
 
-	// SmPlay - browser client sends to server to start streaming back the recorded video
+	// SmPlay - browser client sends to server to start streaming back the recorded video.
+	// The optional ids field selects the recordings to play, in order. All recordings are played when empty.
 	SmPlay
 
 	// SmError - error
 	SmError
+
+	// SmLive - browser client sends to server to watch a recording in progress. The optional ids
+	// field selects the recording session to watch. The most recent session is used when empty.
+	SmLive
+
+	// SmCandidate - trickle ICE candidate, sent in both directions once the session description has been sent
+	SmCandidate
+
+	// SmShutdown - server notifies the browser client that it is shutting down. Recordings in progress are saved.
+	SmShutdown
+
+	// SmSeek - playback client sends to restart the current recording from the key frame at or
+	// before the offset in seconds given in the data field.
+	SmSeek
+
+	// SmPause - playback client sends to pause streaming.
+	SmPause
+
+	// SmResume - playback client sends to resume a paused stream.
+	SmResume
+
+	// SmRate - playback client sends to change the playback rate given in the data field, e.g. "2" or "0.5".
+	SmRate
 )
 
 // String - returns the string value
@@ -55,8 +87,9 @@ func (t SignalMessageType) String() string {
 // SignalMessage represents the format of a signal message over the websocket
 type SignalMessage struct {
 	id   SignalMessageType
-	Op   string `json:"op"`
-	Data string `json:"data"`
+	Op   string   `json:"op"`
+	Data string   `json:"data"`
+	IDs  []string `json:"ids,omitempty"`
 }
 
 // Marshal populates the op field from the id field
@@ -121,22 +154,19 @@ func Encode(obj interface{}) string {
 	return base64.StdEncoding.EncodeToString(b)
 }
 
-// Decode decodes the input from base64
-// It can optionally unzip the input after decoding
-func Decode(in string, obj interface{}) {
+// TryDecode decodes the input from base64
+// It can optionally unzip the input after decoding. Malformed input is returned as an error.
+func TryDecode(in string, obj interface{}) error {
 	b, err := base64.StdEncoding.DecodeString(in)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if compress {
 		b = unzip(b)
 	}
 
-	err = json.Unmarshal(b, obj)
-	if err != nil {
-		panic(err)
-	}
+	return json.Unmarshal(b, obj)
 }
 
 func zip(in []byte) []byte {
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricVec is a counter or gauge with an optional label, written in the Prometheus text
+// exposition format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+type metricVec struct {
+	name  string
+	help  string
+	kind  string // counter or gauge
+	label string // empty for a metric without labels
+
+	values map[string]float64
+	mutex  sync.Mutex
+}
+
+func newCounter(name, help, label string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "counter", label: label, values: make(map[string]float64)}
+}
+
+func newGauge(name, help, label string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "gauge", label: label, values: make(map[string]float64)}
+}
+
+// add increments the value for the given label value. Use an empty label value for metrics without a label.
+func (m *metricVec) add(labelValue string, v float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.values[labelValue] += v
+}
+
+// inc increments the value for the given label value by one.
+func (m *metricVec) inc(labelValue string) {
+	m.add(labelValue, 1)
+}
+
+// set sets the value for the given label value.
+func (m *metricVec) set(labelValue string, v float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.values[labelValue] = v
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	if m.label == "" {
+		fmt.Fprintf(w, "%s %v\n", m.name, m.values[""])
+		return
+	}
+
+	labelValues := make([]string, 0, len(m.values))
+	for lv := range m.values {
+		labelValues = append(labelValues, lv)
+	}
+	sort.Strings(labelValues)
+
+	for _, lv := range labelValues {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %v\n", m.name, m.label, labelEscaper.Replace(lv), m.values[lv])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Metrics holds the media and signaling metrics served on /metrics.
+type Metrics struct {
+	clients        *metricVec
+	signalMessages *metricVec
+	iceStates      *metricVec
+
+	rtpPacketsReceived  *metricVec
+	rtpBytesReceived    *metricVec
+	rtpPacketsLost      *metricVec
+	rtpPacketsDiscarded *metricVec
+	rtpPacketsSent      *metricVec
+	rtpBytesSent        *metricVec
+	rtpPacketsResent    *metricVec
+	plisSent            *metricVec
+	nacksSent           *metricVec
+
+	recordings     *metricVec
+	recordingBytes *metricVec
+}
+
+// CreateNewMetrics creates a new set of metrics.
+func CreateNewMetrics() *Metrics {
+	return &Metrics{
+		clients:        newGauge("pts_clients", "Connected peer clients by type.", "type"),
+		signalMessages: newCounter("pts_signal_messages_total", "Signal messages received from browser clients by op.", "op"),
+		iceStates:      newCounter("pts_ice_state_transitions_total", "ICE connection state transitions by new state.", "state"),
+
+		rtpPacketsReceived:  newCounter("pts_rtp_received_packets_total", "RTP packets received from recording clients by track kind.", "kind"),
+		rtpBytesReceived:    newCounter("pts_rtp_received_bytes_total", "RTP bytes received from recording clients by track kind.", "kind"),
+		rtpPacketsLost:      newCounter("pts_rtp_lost_packets_total", "RTP packets missing from the streams of recording clients by track kind.", "kind"),
+		rtpPacketsDiscarded: newCounter("pts_rtp_discarded_packets_total", "Duplicate or late RTP packets from recording clients left out of recordings by track kind.", "kind"),
+		rtpPacketsSent:      newCounter("pts_rtp_sent_packets_total", "RTP packets sent to playback and live clients by track kind.", "kind"),
+		rtpBytesSent:        newCounter("pts_rtp_sent_bytes_total", "RTP bytes sent to playback and live clients by track kind.", "kind"),
+		rtpPacketsResent:    newCounter("pts_rtp_retransmitted_packets_total", "RTP packets resent to playback and live clients in answer to NACKs by track kind.", "kind"),
+		plisSent:            newCounter("pts_plis_sent_total", "Picture loss indications sent to recording clients.", ""),
+		nacksSent:           newCounter("pts_nacked_packets_total", "Missing RTP packets requested from recording clients with NACKs by track kind.", "kind"),
+
+		recordings:     newGauge("pts_recordings", "Stored recordings.", ""),
+		recordingBytes: newGauge("pts_recording_bytes", "Total size of the stored recordings in bytes.", ""),
+	}
+}
+
+// metrics is the process wide set of metrics.
+var metrics = CreateNewMetrics()
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	buf := bytes.Buffer{}
+	for _, v := range []*metricVec{
+		m.clients,
+		m.signalMessages,
+		m.iceStates,
+		m.rtpPacketsReceived,
+		m.rtpBytesReceived,
+		m.rtpPacketsLost,
+		m.rtpPacketsDiscarded,
+		m.rtpPacketsSent,
+		m.rtpBytesSent,
+		m.rtpPacketsResent,
+		m.plisSent,
+		m.nacksSent,
+		m.recordings,
+		m.recordingBytes,
+	} {
+		v.write(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// metricsHandler serves GET /metrics. Gauges are sampled from the client registry and the
+// recording store on each scrape. Admins only.
+func (s *SignalServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.authorize(w, r, RoleAdmin) == nil {
+		return
+	}
+
+	counts := map[string]int{}
+	for _, ct := range []PeerClientType{PctUndecided, PctRecord, PctPlayback, PctLive} {
+		counts[ct.String()] = 0
+	}
+	for _, c := range s.clients.List() {
+		counts[c.Info().Type]++
+	}
+	for ct, n := range counts {
+		metrics.clients.set(ct, float64(n))
+	}
+
+	recs := s.services.Recordings.List()
+	size := int64(0)
+	for _, rec := range recs {
+		size += rec.Size
+	}
+	metrics.recordings.set("", float64(len(recs)))
+	metrics.recordingBytes.set("", float64(size))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := metrics.WriteTo(w)
+	if err != nil {
+		log.Printf("Unable to write metrics: %s\n", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+// retransmitBufferSize is the number of recently sent packets kept per track for retransmission.
+// At typical video bitrates this covers well over a second.
+const retransmitBufferSize = 512
+
+// retransmitBuffer is a ring buffer of the packets recently sent on an outgoing track, keyed by
+// their rewritten sequence number, so that packets the browser reports lost in an RTCP NACK
+// can be sent again. Safe for concurrent use.
+type retransmitBuffer struct {
+	packets [retransmitBufferSize]*rtp.Packet
+	mutex   sync.Mutex
+}
+
+func newRetransmitBuffer() *retransmitBuffer {
+	return &retransmitBuffer{}
+}
+
+// add keeps a copy of a packet that has been sent. The payload is shared as it is never modified.
+func (b *retransmitBuffer) add(pkt *rtp.Packet) {
+	cp := *pkt
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.packets[pkt.SequenceNumber%retransmitBufferSize] = &cp
+}
+
+// get returns a copy of the packet sent with the sequence number or nil if it is no longer buffered.
+func (b *retransmitBuffer) get(seq uint16) *rtp.Packet {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	pkt := b.packets[seq%retransmitBufferSize]
+	if pkt == nil || pkt.SequenceNumber != seq {
+		return nil
+	}
+	cp := *pkt
+	return &cp
+}
+
+// nackPairs packs sequence numbers, in ascending order, into the NACK pairs of an RTCP
+// TransportLayerNack: a packet id and a bitmap of the 16 packets following it.
+func nackPairs(seqs []uint16) []rtcp.NackPair {
+	pairs := []rtcp.NackPair{}
+	for _, seq := range seqs {
+		if n := len(pairs); n > 0 {
+			if d := seq - pairs[n-1].PacketID; d >= 1 && d <= 16 {
+				pairs[n-1].LostPackets |= rtcp.PacketBitmap(1 << (d - 1))
+				continue
+			}
+		}
+		pairs = append(pairs, rtcp.NackPair{PacketID: seq})
+	}
+	return pairs
+}
+
+// requestRetransmission asks the publisher to send the missing packets of a recorded track again.
+func (c *PeerClient) requestRetransmission(track *webrtc.Track, seqs []uint16) {
+	err := c.pc.WriteRTCP([]rtcp.Packet{&rtcp.TransportLayerNack{
+		MediaSSRC: track.SSRC(),
+		Nacks:     nackPairs(seqs),
+	}})
+	if err != nil {
+		log.Printf("Client %s unable to request %d missing packets: %s\n", c.id, len(seqs), err)
+		return
+	}
+	metrics.nacksSent.add(track.Kind().String(), float64(len(seqs)))
+}
+
+// retransmit sends the packets requested in a NACK again on the track. Packets that are no longer
+// buffered are skipped; the browser recovers from those with a key frame. Returns the number
+// of packets requested and resent.
+func (c *PeerClient) retransmit(track *webrtc.Track, buffer *retransmitBuffer, nack *rtcp.TransportLayerNack) (requested, resent int) {
+	kind := track.Kind().String()
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			requested++
+			pkt := buffer.get(seq)
+			if pkt == nil {
+				continue
+			}
+			if err := track.WriteRTP(pkt); err != nil {
+				log.Printf("Client %s unable to retransmit packet %d: %s\n", c.id, seq, err)
+				return requested, resent
+			}
+			resent++
+			metrics.rtpPacketsResent.inc(kind)
+		}
+	}
+	return requested, resent
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+func TestNACKPairs(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint16
+		want []rtcp.NackPair
+	}{
+		{"none", nil, []rtcp.NackPair{}},
+		{"single", []uint16{5}, []rtcp.NackPair{{PacketID: 5}}},
+		{"bitmap", []uint16{5, 6, 21}, []rtcp.NackPair{{PacketID: 5, LostPackets: 1 | 1<<15}}},
+		{"beyond the bitmap", []uint16{5, 22}, []rtcp.NackPair{{PacketID: 5}, {PacketID: 22}}},
+		{"wraparound", []uint16{65535, 0, 1}, []rtcp.NackPair{{PacketID: 65535, LostPackets: 0x3}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nackPairs(tt.seqs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetransmitBuffer(t *testing.T) {
+	b := newRetransmitBuffer()
+	if pkt := b.get(1); pkt != nil {
+		t.Errorf("empty buffer returned packet %d", pkt.SequenceNumber)
+	}
+
+	for seq := 0; seq < retransmitBufferSize+10; seq++ {
+		b.add(&rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(seq)}, Payload: []byte{byte(seq)}})
+	}
+
+	// The oldest packets have been overwritten by the ones sharing their slot
+	if pkt := b.get(5); pkt != nil {
+		t.Errorf("overwritten packet returned as %d", pkt.SequenceNumber)
+	}
+
+	pkt := b.get(retransmitBufferSize + 5)
+	if pkt == nil || pkt.SequenceNumber != retransmitBufferSize+5 {
+		t.Fatalf("got %v, want packet %d", pkt, retransmitBufferSize+5)
+	}
+
+	// The packet returned is a copy, so rewriting its header for a resend keeps the buffered one
+	pkt.SequenceNumber++
+	if again := b.get(retransmitBufferSize + 5); again == nil {
+		t.Error("buffered packet changed by the caller")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NATMapping advertises public IPs for the host candidates gathered on the local addresses when
+// the server runs behind a 1:1 NAT, which forwards every port of the public address to the
+// private one. This version of webrtc cannot do it while gathering, so the candidates are
+// rewritten as they are sent to the browser, both in the answer and when trickled.
+type NATMapping struct {
+	// srflx advertises the public IPs as server reflexive candidates next to the host
+	// candidates instead of replacing the host candidate addresses.
+	srflx bool
+
+	// Public IPs by private IP, and the public IPs used for any other address of the family
+	byPrivate map[string]string
+	ipv4      string
+	ipv6      string
+}
+
+// CreateNewNATMapping creates the mapping for the given public IPs ("public" or "public/private")
+// advertised as the given candidate type ("host" or "srflx").
+func CreateNewNATMapping(ips []string, candidateType string) (*NATMapping, error) {
+	m := NATMapping{
+		byPrivate: make(map[string]string),
+	}
+
+	switch strings.ToLower(candidateType) {
+	case "", "host":
+	case "srflx":
+		m.srflx = true
+	default:
+		return nil, fmt.Errorf("nat 1:1 ips can only be advertised as host or srflx candidates")
+	}
+
+	for _, raw := range ips {
+		parts := strings.Split(raw, "/")
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("invalid nat 1:1 ip: %s", raw)
+		}
+
+		public := net.ParseIP(parts[0])
+		if public == nil {
+			return nil, fmt.Errorf("invalid nat 1:1 ip: %s", raw)
+		}
+
+		if len(parts) == 2 {
+			private := net.ParseIP(parts[1])
+			if private == nil || (private.To4() == nil) != (public.To4() == nil) {
+				return nil, fmt.Errorf("invalid nat 1:1 ip: %s", raw)
+			}
+			m.byPrivate[private.String()] = public.String()
+			continue
+		}
+
+		if public.To4() != nil {
+			m.ipv4 = public.String()
+		} else {
+			m.ipv6 = public.String()
+		}
+	}
+
+	return &m, nil
+}
+
+// publicIP returns the public IP the given local address is reachable on, or "" if not mapped.
+func (m *NATMapping) publicIP(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	if public, ok := m.byPrivate[ip.String()]; ok {
+		return public
+	}
+	if ip.To4() != nil {
+		return m.ipv4
+	}
+	return m.ipv6
+}
+
+// Candidates returns the candidates to advertise for a gathered candidate attribute value
+// ("candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> ...").
+// Only host candidates on a mapped address are changed. A nil mapping returns the candidate as is.
+func (m *NATMapping) Candidates(candidate string) []string {
+	fields := strings.Fields(candidate)
+	if m == nil || len(fields) < 8 || fields[6] != "typ" || fields[7] != "host" {
+		return []string{candidate}
+	}
+
+	public := m.publicIP(fields[4])
+	if public == "" {
+		return []string{candidate}
+	}
+
+	if !m.srflx {
+		fields[4] = public
+		return []string{strings.Join(fields, " ")}
+	}
+
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return []string{candidate}
+	}
+
+	// The server reflexive candidate keeps the local preference and component of the host
+	// candidate with the srflx type preference (RFC 8445 5.1.2.1). It needs its own foundation.
+	prefix := ""
+	foundation := fields[0]
+	if strings.HasPrefix(foundation, "candidate:") {
+		prefix = "candidate:"
+		foundation = strings.TrimPrefix(foundation, prefix)
+	}
+	srflx := []string{
+		prefix + "n" + foundation,
+		fields[1],
+		fields[2],
+		strconv.FormatUint(100<<24|priority&0xffffff, 10),
+		public,
+		fields[5],
+		"typ", "srflx",
+		"raddr", fields[4],
+		"rport", fields[5],
+	}
+
+	return []string{candidate, strings.Join(srflx, " ")}
+}
+
+// SDP returns the session description with the candidate lines mapped by Candidates.
+// A nil mapping returns the session description as is.
+func (m *NATMapping) SDP(sd string) string {
+	if m == nil {
+		return sd
+	}
+
+	lines := strings.SplitAfter(sd, "\n")
+	mapped := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			mapped = append(mapped, line)
+			continue
+		}
+
+		value := strings.TrimRight(strings.TrimPrefix(line, "a="), "\r\n")
+		eol := line[len("a=")+len(value):]
+		for _, candidate := range m.Candidates(value) {
+			mapped = append(mapped, "a="+candidate+eol)
+		}
+	}
+	return strings.Join(mapped, "")
+}
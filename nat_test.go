@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCreateNewNATMapping(t *testing.T) {
+	tests := []struct {
+		name          string
+		ips           []string
+		candidateType string
+		valid         bool
+	}{
+		{"public ipv4", []string{"203.0.113.1"}, "", true},
+		{"public ipv6", []string{"2001:db8::1"}, "host", true},
+		{"public and private", []string{"203.0.113.1/10.0.0.1", "203.0.113.2/10.0.0.2"}, "srflx", true},
+		{"unsupported candidate type", []string{"203.0.113.1"}, "relay", false},
+		{"invalid public ip", []string{"example.com"}, "", false},
+		{"invalid private ip", []string{"203.0.113.1/private"}, "", false},
+		{"mixed families", []string{"203.0.113.1/fd00::1"}, "", false},
+		{"too many parts", []string{"203.0.113.1/10.0.0.1/10.0.0.2"}, "", false},
+	}
+	for _, tt := range tests {
+		_, err := CreateNewNATMapping(tt.ips, tt.candidateType)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: got error %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestNATMappingCandidates(t *testing.T) {
+	const (
+		host  = "candidate:1 1 udp 2130706431 10.0.0.1 50000 typ host"
+		host2 = "candidate:2 1 udp 2130706431 10.0.0.2 50001 typ host"
+		host6 = "candidate:3 1 udp 2130706431 fd00::1 50002 typ host"
+		srflx = "candidate:4 1 udp 1694498815 198.51.100.1 50003 typ srflx raddr 10.0.0.1 rport 50000"
+	)
+
+	single, err := CreateNewNATMapping([]string{"203.0.113.1"}, "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := CreateNewNATMapping([]string{"203.0.113.1/10.0.0.1", "203.0.113.2/10.0.0.2"}, "srflx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		mapping   *NATMapping
+		candidate string
+		want      []string
+	}{
+		{"no mapping", nil, host, []string{host}},
+		{"host", single, host, []string{"candidate:1 1 udp 2130706431 203.0.113.1 50000 typ host"}},
+		{"host of another family", single, host6, []string{host6}},
+		{"not a host candidate", single, srflx, []string{srflx}},
+		{"malformed", single, "candidate:1 1 udp", []string{"candidate:1 1 udp"}},
+		{"srflx", pairs, host2, []string{host2, "candidate:n2 1 udp 1694498815 203.0.113.2 50001 typ srflx raddr 10.0.0.2 rport 50001"}},
+		{"srflx unmapped address", pairs, host6, []string{host6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.mapping.Candidates(tt.candidate); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNATMappingSDP(t *testing.T) {
+	m, err := CreateNewNATMapping([]string{"203.0.113.1"}, "srflx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd := "v=0\r\n" +
+		"a=candidate:1 1 udp 2130706431 10.0.0.1 50000 typ host\r\n" +
+		"a=end-of-candidates\r\n"
+	want := "v=0\r\n" +
+		"a=candidate:1 1 udp 2130706431 10.0.0.1 50000 typ host\r\n" +
+		"a=candidate:n1 1 udp 1694498815 203.0.113.1 50000 typ srflx raddr 10.0.0.1 rport 50000\r\n" +
+		"a=end-of-candidates\r\n"
+	if got := m.SDP(sd); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	var none *NATMapping
+	if got := none.SDP(sd); got != sd {
+		t.Errorf("nil mapping changed the sdp to %q", got)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Opus stream parameters used for WebRTC audio.
+const (
+	opusChannels = 2
+
+	// opusPreSkip is the number of samples a decoder discards at the start of the stream.
+	// https://tools.ietf.org/html/rfc7845#section-4.2
+	opusPreSkip = 3840
+)
+
+// opusHead builds the Opus identification header used by Ogg and as Matroska CodecPrivate.
+// https://tools.ietf.org/html/rfc7845#section-5.1
+func opusHead() []byte {
+	head := make([]byte, 19)
+	copy(head[0:], "OpusHead")
+	head[8] = 1 // version
+	head[9] = opusChannels
+	binary.LittleEndian.PutUint16(head[10:], opusPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], audioClockRate) // original input sample rate
+	binary.LittleEndian.PutUint16(head[16:], 0)              // output gain
+	head[18] = 0                                             // channel mapping family
+	return head
+}
+
+// opusTags builds the Opus comment header.
+// https://tools.ietf.org/html/rfc7845#section-5.2
+func opusTags() []byte {
+	const vendor = "pion-the-sky"
+
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags[0:], "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	binary.LittleEndian.PutUint32(tags[12+len(vendor):], 0) // user comment count
+	return tags
+}
+
+// opusPacketSamples returns the number of 48kHz samples in an Opus packet.
+// https://tools.ietf.org/html/rfc6716#section-3.1
+func opusPacketSamples(packet []byte) int {
+	if len(packet) < 1 {
+		return 0
+	}
+
+	toc := packet[0]
+	config := toc >> 3
+
+	var frameSamples int
+	switch {
+	case config < 12: // SILK: 10, 20, 40, 60ms
+		frameSamples = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid: 10, 20ms
+		frameSamples = []int{480, 960}[config%2]
+	default: // CELT: 2.5, 5, 10, 20ms
+		frameSamples = []int{120, 240, 480, 960}[config%4]
+	}
+
+	frames := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	return frames * frameSamples
+}
+
+// Ogg page header flags.
+const (
+	oggContinued = 0x01
+	oggBOS       = 0x02
+	oggEOS       = 0x04
+)
+
+var oggCRCTable = func() [256]uint32 {
+	table := [256]uint32{}
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+func oggCRC(b []byte) uint32 {
+	crc := uint32(0)
+	for _, v := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^v]
+	}
+	return crc
+}
+
+// oggOpusWriter writes Opus packets into an Ogg stream, one packet per page.
+// https://tools.ietf.org/html/rfc7845
+type oggOpusWriter struct {
+	w       io.Writer
+	serial  uint32
+	pageSeq uint32
+
+	headerWritten bool
+	granule       uint64
+	started       bool
+	prevTs        uint32
+
+	pending    []byte
+	pendingPos uint64
+}
+
+func newOggOpusWriter(w io.Writer, serial uint32) *oggOpusWriter {
+	return &oggOpusWriter{w: w, serial: serial}
+}
+
+func (ow *oggOpusWriter) writePage(packet []byte, granule uint64, flags byte) error {
+	segments := len(packet)/255 + 1
+	page := make([]byte, 27+segments, 27+segments+len(packet))
+	copy(page[0:], "OggS")
+	page[4] = 0 // version
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], ow.serial)
+	binary.LittleEndian.PutUint32(page[18:], ow.pageSeq)
+	page[26] = byte(segments)
+	for i := 0; i < segments-1; i++ {
+		page[27+i] = 255
+	}
+	page[27+segments-1] = byte(len(packet) % 255)
+	page = append(page, packet...)
+
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	ow.pageSeq++
+
+	_, err := ow.w.Write(page)
+	return err
+}
+
+func (ow *oggOpusWriter) writeHeaders() error {
+	if err := ow.writePage(opusHead(), 0, oggBOS); err != nil {
+		return err
+	}
+	return ow.writePage(opusTags(), 0, 0)
+}
+
+// writePacket adds an Opus packet with the given RTP timestamp. Gaps in the timestamps
+// (e.g. discontinuous transmission) advance the granule position accordingly.
+func (ow *oggOpusWriter) writePacket(packet []byte, ts uint32) error {
+	if len(packet) == 0 || len(packet) > 255*254 {
+		return nil
+	}
+
+	if !ow.headerWritten {
+		if err := ow.writeHeaders(); err != nil {
+			return err
+		}
+		ow.headerWritten = true
+		ow.granule = opusPreSkip
+	}
+
+	// Pages are written one packet behind so the last one can be flagged as the end of stream.
+	if ow.pending != nil {
+		if err := ow.writePage(ow.pending, ow.pendingPos, 0); err != nil {
+			return err
+		}
+	}
+
+	if ow.started {
+		if delta := int32(ts - ow.prevTs); delta > 0 {
+			ow.granule += uint64(delta)
+		}
+	}
+	ow.started = true
+	ow.prevTs = ts
+
+	ow.pending = append([]byte(nil), packet...)
+	ow.pendingPos = ow.granule + uint64(opusPacketSamples(packet))
+	return nil
+}
+
+// Close writes the final page of the stream.
+func (ow *oggOpusWriter) Close() error {
+	if ow.pending == nil {
+		return nil
+	}
+	err := ow.writePage(ow.pending, ow.pendingPos, oggEOS)
+	ow.pending = nil
+	return err
+}
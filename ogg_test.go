@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestOpusPacketSamples(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   int
+	}{
+		{"empty", nil, 0},
+		{"silk 20ms", []byte{1 << 3}, 960},
+		{"silk 60ms", []byte{3 << 3}, 2880},
+		{"hybrid 10ms", []byte{12 << 3}, 480},
+		{"celt 2.5ms", []byte{16 << 3}, 120},
+		{"celt 20ms", []byte{31 << 3}, 960},
+		{"two frames", []byte{31<<3 | 1}, 1920},
+		{"two frames of different sizes", []byte{31<<3 | 2}, 1920},
+		{"arbitrary frames", []byte{16<<3 | 3, 5}, 600},
+		{"arbitrary frames truncated", []byte{16<<3 | 3}, 0},
+	}
+	for _, tt := range tests {
+		if got := opusPacketSamples(tt.packet); got != tt.want {
+			t.Errorf("%s: got %d samples, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOggCRC(t *testing.T) {
+	// CRC-32 with polynomial 0x04c11db7, no reflection, no initial or final xor
+	if got := oggCRC([]byte("123456789")); got != 0x89a1897f {
+		t.Errorf("got %08x, want 89a1897f", got)
+	}
+}
+
+// oggTestPage is a page read back from an Ogg stream.
+type oggTestPage struct {
+	flags   byte
+	granule uint64
+	seq     uint32
+	packet  []byte
+}
+
+func oggTestPages(t *testing.T, b []byte) []oggTestPage {
+	pages := []oggTestPage{}
+	for len(b) > 0 {
+		if len(b) < 27 || string(b[:4]) != "OggS" {
+			t.Fatalf("invalid page header %x", b)
+		}
+		segments := int(b[26])
+		size := 27 + segments
+		for _, s := range b[27 : 27+segments] {
+			size += int(s)
+		}
+
+		page := append([]byte(nil), b[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if oggCRC(page) != crc {
+			t.Errorf("page %d has an invalid checksum", len(pages))
+		}
+
+		pages = append(pages, oggTestPage{
+			flags:   b[5],
+			granule: binary.LittleEndian.Uint64(b[6:]),
+			seq:     binary.LittleEndian.Uint32(b[18:]),
+			packet:  b[27+segments : size],
+		})
+		b = b[size:]
+	}
+	return pages
+}
+
+func TestOggOpusWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+	ow := newOggOpusWriter(&buf, 1)
+
+	packet := []byte{31 << 3, 0xaa} // 20ms
+	long := append([]byte{31 << 3}, make([]byte, 300)...)
+	for _, p := range []struct {
+		packet []byte
+		ts     uint32
+	}{
+		{packet, 0},
+		{long, 960},
+		{packet, 2880}, // after 20ms of discontinuous transmission
+	} {
+		if err := ow.writePacket(p.packet, p.ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ow.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []oggTestPage{
+		{oggBOS, 0, 0, opusHead()},
+		{0, 0, 1, opusTags()},
+		{0, opusPreSkip + 960, 2, packet},
+		{0, opusPreSkip + 1920, 3, long},
+		{oggEOS, opusPreSkip + 3840, 4, packet},
+	}
+	if got := oggTestPages(t, buf.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("pages %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media/rtpdump"
+)
+
+// Default RTP clock rates used when a recording does not describe its tracks.
+const (
+	videoClockRate = 90000
+	audioClockRate = 48000
+)
+
+// maxClockDrift is how far a packet's RTP timestamp may drift from its capture offset
+// before playback re-anchors the track's clock.
+const maxClockDrift = time.Second
+
+// Playback rates accepted by RATE.
+const (
+	minPlaybackRate = 0.25
+	maxPlaybackRate = 4
+)
+
+// trackRewriter rewrites recorded packets for an output track so that consecutive
+// clips are seen by the browser as one continuous stream.
+type trackRewriter struct {
+	track     *webrtc.Track
+	pt        uint8
+	clockRate uint32
+	rate      float64
+	stats     *senderStats
+	sent      *retransmitBuffer
+
+	seq       uint16
+	tsbegin   uint32
+	tsmod     uint32
+	tsprev    uint32
+	clipreset bool
+	lastSent  time.Time
+
+	// Fixed offsets applied to relayed live packets, taken from the first one
+	relaying  bool
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+func newTrackRewriter(track *webrtc.Track, pt uint8, stats *senderStats, sent *retransmitBuffer) *trackRewriter {
+	return &trackRewriter{
+		track:     track,
+		pt:        pt,
+		clockRate: track.Codec().ClockRate,
+		rate:      1,
+		stats:     stats,
+		sent:      sent,
+		seq:       uint16(100),
+	}
+}
+
+// reset marks the start of a new clip.
+func (w *trackRewriter) reset() {
+	w.clipreset = true
+}
+
+// setRate sets the playback rate. Timestamps are scaled so they keep pace with the wall clock.
+func (w *trackRewriter) setRate(rate float64) {
+	w.rate = rate
+}
+
+// write rewrites the packet's ssrc, payload type, sequence number and timestamp and sends it.
+// Packets are numbered in the order they are written, stitching the clips played back into
+// one stream.
+func (w *trackRewriter) write(pkt *rtp.Packet) error {
+	// Adjust the timestamp and sequence for streaming. The first packet of a clip is
+	// advanced by the wall clock time since the last packet sent so the timeline stays continuous.
+	tsdelta := uint32(0)
+	if w.clipreset {
+		w.clipreset = false
+		if !w.lastSent.IsZero() {
+			tsdelta = uint32(time.Since(w.lastSent).Seconds()*float64(w.clockRate)) + 1
+		}
+	} else if w.rate != 1 {
+		tsdelta = uint32(int32(float64(int32(pkt.Timestamp-w.tsprev)) / w.rate))
+	} else {
+		tsdelta = pkt.Timestamp - w.tsprev
+	}
+	w.tsprev = pkt.Timestamp
+	w.lastSent = time.Now()
+
+	if w.tsbegin == 0 {
+		w.tsbegin = 1
+		w.tsmod = w.tsbegin
+	} else {
+		w.tsmod = w.tsmod + tsdelta
+	}
+	pkt.SequenceNumber = w.seq
+	w.seq++
+	pkt.Timestamp = w.tsmod
+
+	return w.send(pkt)
+}
+
+// relay rewrites a live packet's ssrc, payload type, sequence number and timestamp and sends it.
+// The sequence number and timestamp are shifted by fixed offsets taken from the first packet
+// relayed, so packets lost or reordered on the way from the publisher show up as such and the
+// viewer's NACKs and jitter buffer can deal with them.
+func (w *trackRewriter) relay(pkt *rtp.Packet) error {
+	if !w.relaying {
+		w.relaying = true
+		w.seqOffset = w.seq - pkt.SequenceNumber
+		w.tsOffset = 1 - pkt.Timestamp
+	}
+	pkt.SequenceNumber += w.seqOffset
+	pkt.Timestamp += w.tsOffset
+
+	return w.send(pkt)
+}
+
+// send sends a packet on the output track and keeps it for retransmission.
+func (w *trackRewriter) send(pkt *rtp.Packet) error {
+	pkt.SSRC = w.track.SSRC()
+
+	// Work around for playback in safari, specifically for h264.
+	// https://github.com/pion/webrtc/issues/716
+	pkt.PayloadType = w.pt
+
+	err := w.track.WriteRTP(pkt)
+	if err != nil {
+		return err
+	}
+
+	w.sent.add(pkt)
+
+	size := pkt.MarshalSize()
+	w.stats.sent(pkt.Timestamp, size)
+
+	kind := w.track.Kind().String()
+	metrics.rtpPacketsSent.inc(kind)
+	metrics.rtpBytesSent.add(kind, float64(size))
+	return nil
+}
+
+// trackClock maps the RTP timestamps of one track onto the playback timeline of a clip.
+type trackClock struct {
+	clockRate uint32
+	started   bool
+	firstTs   uint32
+	base      time.Duration
+}
+
+// due returns when, relative to the start of the clip, a packet with the given timestamp and
+// rtpdump offset should be sent. Packets sharing a timestamp (one frame) are due together.
+func (k *trackClock) due(ts uint32, offset time.Duration) time.Duration {
+	if !k.started {
+		k.started = true
+		k.firstTs = ts
+		k.base = offset
+	}
+
+	elapsed := time.Duration(int32(ts-k.firstTs)) * time.Second / time.Duration(k.clockRate)
+	d := k.base + elapsed
+
+	// Re-anchor if the timestamps have jumped away from the capture time. Offsets are only
+	// recorded for newer recordings so a zero offset is never used to re-anchor.
+	if offset > 0 && (d-offset > maxClockDrift || offset-d > maxClockDrift) {
+		k.firstTs = ts
+		k.base = offset
+		d = offset
+	}
+	return d
+}
+
+// playbackClock maps the clip timeline onto the wall clock at the current playback rate.
+type playbackClock struct {
+	wall  time.Time     // when the anchor point of the clip was due
+	media time.Duration // anchor point on the clip timeline
+	rate  float64
+}
+
+// at returns when a point on the clip timeline is due.
+func (k *playbackClock) at(d time.Duration) time.Time {
+	return k.wall.Add(time.Duration(float64(d-k.media) / k.rate))
+}
+
+// setRate changes the rate from now on without moving the current position on the clip timeline.
+func (k *playbackClock) setRate(rate float64) {
+	if rate == k.rate {
+		return
+	}
+	now := time.Now()
+	k.media += time.Duration(float64(now.Sub(k.wall)) * k.rate)
+	k.wall = now
+	k.rate = rate
+}
+
+// playbackControl holds the SEEK, PAUSE, RESUME and RATE requests of a playback client until the
+// streaming loop applies them. Safe for concurrent use.
+type playbackControl struct {
+	paused bool
+	rate   float64
+	seekTo float64 // seconds, negative when no seek is pending
+
+	// Signaled whenever the state changes
+	changed chan struct{}
+	mutex   sync.Mutex
+}
+
+func newPlaybackControl() *playbackControl {
+	return &playbackControl{
+		rate:    1,
+		seekTo:  -1,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// apply updates the state from a control signal message.
+func (p *playbackControl) apply(op SignalMessageType, data string) error {
+	var value float64
+	if op == SmSeek || op == SmRate {
+		var err error
+		value, err = strconv.ParseFloat(strings.TrimSpace(data), 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s value %q", op, data)
+		}
+	}
+
+	p.mutex.Lock()
+	switch op {
+	case SmSeek:
+		if value < 0 {
+			p.mutex.Unlock()
+			return fmt.Errorf("cannot seek to a negative offset %v", value)
+		}
+		p.seekTo = value
+	case SmPause:
+		p.paused = true
+	case SmResume:
+		p.paused = false
+	case SmRate:
+		if value < minPlaybackRate || value > maxPlaybackRate {
+			p.mutex.Unlock()
+			return fmt.Errorf("playback rate must be between %v and %v", minPlaybackRate, maxPlaybackRate)
+		}
+		p.rate = value
+	}
+	p.mutex.Unlock()
+
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// state returns the current state and takes the pending seek, if any.
+func (p *playbackControl) state() (paused bool, rate float64, seekTo float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	seekTo = p.seekTo
+	p.seekTo = -1
+	return p.paused, p.rate, seekTo
+}
+
+// streamVideoToTrack streams the recorded clips back to the browser on the given video and audio tracks.
+func (c *PeerClient) streamVideoToTrack(video, audio *trackRewriter) {
+	c.wg.Add(1)
+	defer func() {
+		log.Printf("StreamTo track loop exiting client id:%s\n", c.id)
+		c.wg.Done()
+	}()
+
+	for { // Loop thru the video clips
+		if c.IsClosed() {
+			return
+		}
+
+		recs := c.playlistRecordings()
+		if len(recs) == 0 {
+			log.Printf("Client %s has no recordings left to stream.\n", c.id)
+			return
+		}
+
+		for _, rec := range recs {
+			if c.IsClosed() {
+				return
+			}
+
+			log.Printf("Started streaming %s to Client %s...\n", rec.ID, c.id)
+
+			err := c.streamClip(rec, video, audio)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if c.IsClosed() {
+				return
+			}
+			log.Printf("Finished streaming %s to Client %s...\n", rec.ID, c.id)
+		}
+	}
+}
+
+// playlistRecordings returns the recordings to play in order. Without a playlist the clips the
+// client may play are played back in the order they were recorded. Recordings deleted since PLAY
+// are skipped.
+func (c *PeerClient) playlistRecordings() []*Recording {
+	if len(c.playlist) == 0 {
+		// Only the recordings in the negotiated codec can be streamed to this client
+		recs := []*Recording{}
+		for _, rec := range c.services.ReadableRecordings(c.principal) {
+			if codec := rec.VideoCodec(); codec == "" || strings.EqualFold(codec, c.vc.Name) {
+				recs = append(recs, rec)
+			}
+		}
+		return recs
+	}
+
+	recs := make([]*Recording, 0, len(c.playlist))
+	for _, id := range c.playlist {
+		rec, err := c.services.Recordings.Get(id)
+		if err != nil {
+			log.Printf("Client %s skipping recording %s: %s\n", c.id, id, err)
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// streamClip streams a single recording in real time, restarting it whenever the browser seeks.
+func (c *PeerClient) streamClip(rec *Recording, video, audio *trackRewriter) error {
+	from := 0.0
+	for {
+		seekTo, err := c.streamClipFrom(rec, video, audio, from)
+		if err != nil || seekTo < 0 {
+			return err
+		}
+		log.Printf("Client %s seeking to %.2fs in %s.\n", c.id, seekTo, rec.ID)
+		from = seekTo
+	}
+}
+
+// streamClipFrom streams a recording from the key frame at or before the offset in seconds. Audio
+// and video packets are scheduled from their rtpdump offsets and RTP timestamps, which keeps the
+// two tracks in sync. Returns the offset to seek to, or -1 once the clip has been streamed.
+func (c *PeerClient) streamClipFrom(rec *Recording, video, audio *trackRewriter, from float64) (float64, error) {
+	rc, err := c.services.Recordings.Open(rec.ID)
+	if err != nil {
+		return -1, err
+	}
+	defer rc.Close()
+
+	r, _, err := rtpdump.NewReader(rc)
+	if err != nil {
+		return -1, err
+	}
+
+	video.reset()
+	audio.reset()
+
+	videoClock := trackClock{clockRate: videoClockRate}
+	audioClock := trackClock{clockRate: audioClockRate}
+	for _, t := range rec.Tracks {
+		if t.ClockRate == 0 {
+			continue
+		}
+		if t.Kind == webrtc.RTPCodecTypeAudio.String() {
+			audioClock.clockRate = t.ClockRate
+		} else {
+			videoClock.clockRate = t.ClockRate
+		}
+	}
+
+	// Start on a key frame so the browser can decode the clip from its first frame. Audio before
+	// it is skipped too so the tracks start together. Recordings without a key frame index are
+	// searched for a key frame as they are streamed.
+	codec := strings.ToUpper(rec.VideoCodec())
+	waitKeyFrame := codec != ""
+	startPacket := -1
+	if kf := rec.KeyFrameAt(from); kf != nil {
+		startPacket = kf.Packet
+	}
+	fromOffset := time.Duration(from * float64(time.Second))
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	var timeline playbackClock
+	var pausedAt time.Time
+	started := false
+	rate := 1.0
+	index := -1
+
+	for {
+		if c.IsClosed() {
+			return -1, nil
+		}
+
+		dpkt, err := r.Next()
+		if err == io.EOF {
+			return -1, nil
+		}
+		if err != nil {
+			return -1, err
+		}
+		if dpkt.IsRTCP {
+			continue
+		}
+
+		pkt := &rtp.Packet{}
+		err = pkt.Unmarshal(dpkt.Payload)
+		if err != nil {
+			log.Printf("Client %s skipping malformed packet in %s: %s\n", c.id, rec.ID, err)
+			continue
+		}
+
+		index++
+
+		// Recordings made before audio was captured have no track information; treat them as video.
+		out, clock := video, &videoClock
+		if t := rec.Track(pkt.PayloadType); t != nil && t.Kind == webrtc.RTPCodecTypeAudio.String() {
+			out, clock = audio, &audioClock
+		}
+
+		if waitKeyFrame {
+			if startPacket >= 0 && index < startPacket {
+				continue
+			}
+			if startPacket < 0 && (out != video || dpkt.Offset < fromOffset || !videoPacketIsKeyFrame(codec, pkt.Payload)) {
+				continue
+			}
+			waitKeyFrame = false
+		}
+
+		// The clip timeline starts at the first packet sent
+		due := clock.due(pkt.Timestamp, dpkt.Offset)
+		if !started {
+			started = true
+			timeline = playbackClock{wall: time.Now(), media: due, rate: rate}
+		}
+
+		// Wait until the packet is due, applying the browser's controls as they arrive
+		for {
+			paused, newRate, seekTo := c.control.state()
+			if seekTo >= 0 {
+				video.reset()
+				audio.reset()
+				return seekTo, nil
+			}
+
+			if paused {
+				if pausedAt.IsZero() {
+					pausedAt = time.Now()
+					log.Printf("Client %s paused %s.\n", c.id, rec.ID)
+				}
+				select {
+				case <-c.closeCh:
+					return -1, nil
+				case <-c.control.changed:
+				}
+				continue
+			}
+			if !pausedAt.IsZero() {
+				// Shift the timeline by the time spent paused. The browser sees the pause as a gap.
+				timeline.wall = timeline.wall.Add(time.Since(pausedAt))
+				pausedAt = time.Time{}
+				video.reset()
+				audio.reset()
+				log.Printf("Client %s resumed %s.\n", c.id, rec.ID)
+			}
+
+			if newRate != rate {
+				rate = newRate
+				timeline.setRate(rate)
+				video.setRate(rate)
+				audio.setRate(rate)
+				audio.reset() // muted audio restarts on the wall clock
+				log.Printf("Client %s playing %s at %vx.\n", c.id, rec.ID, rate)
+			}
+
+			wait := time.Until(timeline.at(due))
+			if wait <= 0 {
+				break
+			}
+			timer.Reset(wait)
+			select {
+			case <-c.closeCh:
+				return -1, nil
+			case <-timer.C:
+			case <-c.control.changed:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				continue
+			}
+			break
+		}
+
+		// Audio cannot be played faster or slower without resampling, so it is muted instead.
+		if out == audio && rate != 1 {
+			continue
+		}
+
+		// ---
+		// NOTE: You can alter the packets here for testing.
+		// ---
+		//
+		// For example: Logging the frame header of each vp8 key frame...
+		//
+		// if fh, err := c.decodeVP8FrameHeader(pkt); out == video && err == nil && fh.KeyFrame {
+		// 	log.Printf("[KEYFRAME] %s\n", VP8FrameHeaderToString(fh))
+		// }
+		//
+		// Key frames usually span several packets. See RecordingThumbnail for reassembling and
+		// decoding a whole key frame, which can then be saved with SaveAsPNG.
+
+		err = out.write(pkt)
+		if err != nil {
+			return -1, err
+		}
+	}
+}
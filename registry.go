@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClientInfo is a snapshot of a connected peer client.
+type ClientInfo struct {
+	ID         string    `json:"id"`
+	Subject    string    `json:"subject,omitempty"`
+	Type       string    `json:"type"`
+	RemoteAddr string    `json:"remoteAddr"`
+	ICEState   string    `json:"iceState"`
+	Started    time.Time `json:"started"`
+
+	// Outgoing tracks of playback and live clients
+	Tracks []TrackStats `json:"tracks,omitempty"`
+}
+
+// ClientRegistry keeps track of the connected peer clients. Safe for concurrent use.
+type ClientRegistry struct {
+	clients map[string]*PeerClient
+	mutex   sync.RWMutex
+}
+
+// CreateNewClientRegistry creates an empty client registry.
+func CreateNewClientRegistry() *ClientRegistry {
+	return &ClientRegistry{
+		clients: make(map[string]*PeerClient),
+	}
+}
+
+// Add registers a client.
+func (r *ClientRegistry) Add(c *PeerClient) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.clients[c.id] = c
+}
+
+// Remove unregisters a client.
+func (r *ClientRegistry) Remove(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.clients, id)
+}
+
+// Get returns the client with the given id or nil if it is not connected.
+func (r *ClientRegistry) Get(id string) *PeerClient {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.clients[id]
+}
+
+// List returns the connected clients, oldest first.
+func (r *ClientRegistry) List() []*PeerClient {
+	r.mutex.RLock()
+	clients := make([]*PeerClient, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].started.Before(clients[j].started) })
+	return clients
+}
+
+// Len returns the number of connected clients.
+func (r *ClientRegistry) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.clients)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v2"
+)
+
+// senderReportInterval is how often RTCP sender reports are sent on each outgoing track.
+const senderReportInterval = time.Second
+
+// senderStatsLogInterval is how often the statistics of each outgoing track are logged.
+const senderStatsLogInterval = 10 * time.Second
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+// ntpTime converts a wall clock time to the 64 bit NTP timestamp format used in sender reports.
+func ntpTime(t time.Time) uint64 {
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// TrackStats describes an outgoing track, as sent by the server and as reported back by the
+// browser in RTCP receiver reports.
+type TrackStats struct {
+	Kind         string  `json:"kind"`
+	SSRC         uint32  `json:"ssrc"`
+	PacketsSent  uint32  `json:"packetsSent"`
+	BytesSent    uint32  `json:"bytesSent"`
+	PacketsLost  uint32  `json:"packetsLost"`
+	FractionLost float64 `json:"fractionLost"`
+	JitterMs     float64 `json:"jitterMs"`
+	RTTMs        float64 `json:"rttMs"`
+	NACKs        uint32  `json:"nacks"`
+	Retransmits  uint32  `json:"retransmits"`
+}
+
+// senderStats collects the statistics of an outgoing track for its RTCP sender reports, along with
+// the receiver reports and NACKs the browser sends back. Safe for concurrent use.
+type senderStats struct {
+	clockRate uint32
+
+	// RTP timestamp of the last packet sent and when it was sent, mapping RTP time to wall clock time
+	lastTs   uint32
+	lastSent time.Time
+
+	stats TrackStats
+	mutex sync.Mutex
+}
+
+func newSenderStats(track *webrtc.Track) *senderStats {
+	return &senderStats{
+		clockRate: track.Codec().ClockRate,
+		stats: TrackStats{
+			Kind: track.Kind().String(),
+			SSRC: track.SSRC(),
+		},
+	}
+}
+
+// sent records a packet written to the track.
+func (s *senderStats) sent(ts uint32, size int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Relayed live packets can be sent out of order. Sender reports extrapolate from the newest.
+	if s.lastSent.IsZero() || int32(ts-s.lastTs) >= 0 {
+		s.lastTs = ts
+		s.lastSent = time.Now()
+	}
+	s.stats.PacketsSent++
+	s.stats.BytesSent += uint32(size)
+}
+
+// senderReport returns a sender report for the current time, or nil if nothing has been sent yet.
+// The RTP timestamp is extrapolated from the last packet sent, as the rewritten timestamps of
+// the outgoing track advance with the wall clock.
+func (s *senderStats) senderReport() *rtcp.SenderReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.lastSent.IsZero() {
+		return nil
+	}
+
+	now := time.Now()
+	return &rtcp.SenderReport{
+		SSRC:        s.stats.SSRC,
+		NTPTime:     ntpTime(now),
+		RTPTime:     s.lastTs + uint32(now.Sub(s.lastSent).Seconds()*float64(s.clockRate)),
+		PacketCount: s.stats.PacketsSent,
+		OctetCount:  s.stats.BytesSent,
+	}
+}
+
+// received updates the statistics from a reception report about this track.
+func (s *senderStats) received(report rtcp.ReceptionReport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stats.PacketsLost = report.TotalLost
+	s.stats.FractionLost = float64(report.FractionLost) / 256
+	if s.clockRate > 0 {
+		s.stats.JitterMs = float64(report.Jitter) * 1000 / float64(s.clockRate)
+	}
+
+	// The round trip time is the time since the sender report echoed in LastSenderReport was sent,
+	// less the time the browser held on to it. Both are in the middle 32 bits of the NTP format.
+	if report.LastSenderReport != 0 {
+		now := uint32(ntpTime(time.Now()) >> 16)
+		if rtt := int32(now - report.LastSenderReport - report.Delay); rtt >= 0 {
+			s.stats.RTTMs = float64(rtt) * 1000 / 65536
+		}
+	}
+}
+
+// nacked counts the packets the browser asked to be retransmitted and those that were resent.
+func (s *senderStats) nacked(requested, resent int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stats.NACKs += uint32(requested)
+	s.stats.Retransmits += uint32(resent)
+}
+
+// snapshot returns a copy of the statistics.
+func (s *senderStats) snapshot() TrackStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stats
+}
+
+// sendSenderReports sends a sender report for each outgoing track every senderReportInterval,
+// so the browser can synchronize the audio and video tracks and compute round trip times.
+// The track statistics are logged every senderStatsLogInterval.
+func (c *PeerClient) sendSenderReports(stats ...*senderStats) {
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+	lastLogged := time.Now()
+
+	for {
+		select {
+		case <-c.closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		pkts := []rtcp.Packet{}
+		for _, s := range stats {
+			if sr := s.senderReport(); sr != nil {
+				pkts = append(pkts, sr)
+			}
+		}
+		if len(pkts) == 0 {
+			continue
+		}
+
+		if err := c.pc.WriteRTCP(pkts); err != nil {
+			log.Printf("Client %s unable to send sender reports: %s\n", c.id, err)
+			return
+		}
+
+		if time.Since(lastLogged) >= senderStatsLogInterval {
+			lastLogged = time.Now()
+			for _, s := range stats {
+				ts := s.snapshot()
+				log.Printf("Client %s %s track: sent %d packets, lost %d (%.1f%%), jitter %.1fms, rtt %.1fms, %d nacks, %d retransmits.\n",
+					c.id, ts.Kind, ts.PacketsSent, ts.PacketsLost, ts.FractionLost*100, ts.JitterMs, ts.RTTMs, ts.NACKs, ts.Retransmits)
+			}
+		}
+	}
+}
+
+// readSenderRTCP reads the RTCP packets the browser sends about an outgoing track, sent with
+// sender, until the connection is closed. Receiver reports update the track's statistics and
+// NACKed packets are resent on the track from its retransmit buffer.
+func (c *PeerClient) readSenderRTCP(sender *webrtc.RTPSender, track *webrtc.Track, stats *senderStats, buffer *retransmitBuffer) {
+	for {
+		pkts, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, pkt := range pkts {
+			var reports []rtcp.ReceptionReport
+			switch p := pkt.(type) {
+			case *rtcp.ReceiverReport:
+				reports = p.Reports
+			case *rtcp.SenderReport:
+				reports = p.Reports
+			case *rtcp.TransportLayerNack:
+				stats.nacked(c.retransmit(track, buffer, p))
+			}
+
+			for _, report := range reports {
+				if report.SSRC == stats.stats.SSRC {
+					stats.received(report)
+				}
+			}
+		}
+	}
+}
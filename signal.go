@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/websocket"
 )
@@ -13,23 +15,50 @@ import (
 // In this simple case the peer is the server.
 type SignalServer struct {
 	services *WebRTCService
+	clients  *ClientRegistry
+	auth     *Authenticator
+	mux      *http.ServeMux
+	server   *http.Server
+
+	shuttingDown bool
+	mutex        sync.Mutex
 }
 
-// CreateNewSignalServer creates a new signal server.
-func CreateNewSignalServer(address string, services *WebRTCService) (*SignalServer, error) {
+// CreateNewSignalServer creates a new signal server. Callers are authenticated with auth.
+func CreateNewSignalServer(address string, services *WebRTCService, auth *Authenticator) (*SignalServer, error) {
+
+	srv := SignalServer{
+		services: services,
+		clients:  CreateNewClientRegistry(),
+		auth:     auth,
+		mux:      http.NewServeMux(),
+	}
+
+	srv.mux.HandleFunc("/", srv.rootHandler)
+	srv.mux.HandleFunc("/record", srv.recordHandler)
+	srv.mux.HandleFunc("/play", srv.playHandler)
+
+	srv.mux.HandleFunc("/ws", srv.wsHandler)
+	srv.mux.HandleFunc("/whip", srv.whipHandler)
+	srv.mux.HandleFunc("/whip/", srv.whipHandler)
+	srv.mux.HandleFunc("/whep/", srv.whepHandler)
 
-	srv := SignalServer{services: services}
+	srv.mux.HandleFunc("/api/recordings", srv.recordingsHandler)
+	srv.mux.HandleFunc("/api/recordings/", srv.recordingHandler)
+	srv.mux.HandleFunc("/api/clients", srv.clientsHandler)
+	srv.mux.HandleFunc("/api/clients/", srv.clientHandler)
 
-	http.HandleFunc("/", srv.rootHandler)
-	http.HandleFunc("/record", srv.recordHandler)
-	http.HandleFunc("/play", srv.playHandler)
+	srv.mux.HandleFunc("/metrics", srv.metricsHandler)
 
-	http.HandleFunc("/ws", srv.wsHandler)
+	srv.server = &http.Server{
+		Addr:    address,
+		Handler: srv.mux,
+	}
 
 	go func() {
 		log.Printf("Signal server started and listening on %s\n", address)
-		err := http.ListenAndServe(address, nil)
-		if err != nil {
+		err := srv.server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			panic(err)
 		}
 	}()
@@ -37,6 +66,47 @@ func CreateNewSignalServer(address string, services *WebRTCService) (*SignalServ
 	return &srv, nil
 }
 
+// Shutdown stops accepting new clients, notifies and closes every connected client so that
+// recordings in progress are saved, then shuts down the http server. Clients still closing
+// when ctx expires are abandoned.
+func (s *SignalServer) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.shuttingDown = true
+	s.mutex.Unlock()
+
+	clients := s.clients.List()
+	log.Printf("Signal server shutting down. Closing %d clients.\n", len(clients))
+
+	done := make(chan struct{})
+	go func() {
+		wg := sync.WaitGroup{}
+		for _, c := range clients {
+			wg.Add(1)
+			go func(c *PeerClient) {
+				defer wg.Done()
+				c.Shutdown("The server is shutting down.")
+			}(c)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Timed out waiting for %d clients to close.\n", s.clients.Len())
+	}
+
+	return s.server.Shutdown(ctx)
+}
+
+func (s *SignalServer) isShuttingDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.shuttingDown
+}
+
 func (s *SignalServer) rootHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO: Cache the file.
 	content, err := ioutil.ReadFile("index.html")
@@ -65,17 +135,25 @@ func (s *SignalServer) playHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *SignalServer) wsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.isShuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	if r.Header.Get("Origin") != "http://"+r.Host {
 		http.Error(w, "Origin not allowed", 403)
 		return
 	}
+	principal := s.authorize(w, r, "")
+	if principal == nil {
+		return
+	}
 	conn, err := websocket.Upgrade(w, r, w.Header(), 1024, 1024)
 	if err != nil {
 		http.Error(w, "could not open websocket connection", http.StatusBadRequest)
+		return
 	}
 
-	// TODO: keep a map of clients so connections can be managed properly.
-	_, err = CreateNewPeerClient(conn, s.services)
+	_, err = CreateNewPeerClient(conn, principal, s.services, s.clients)
 	if err != nil {
 		log.Printf("wsHandler error %s\n", err)
 	}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+var (
+	// ErrRecordingNotFound is returned when a recording id is not in the store.
+	ErrRecordingNotFound = errors.New("recording not found")
+
+	// ErrRecordingStoreClosed is returned when storing a recording after the store has been closed.
+	ErrRecordingStoreClosed = errors.New("recording store is closed")
+)
+
+// Recording describes a recorded session held in a RecordingStore.
+type Recording struct {
+	ID       string           `json:"id"`
+	Created  time.Time        `json:"created"`
+	Size     int64            `json:"size"`
+	Duration float64          `json:"duration"` // seconds
+	Packets  int              `json:"packets"`
+	Width    int              `json:"width,omitempty"`
+	Height   int              `json:"height,omitempty"`
+	Tracks   []RecordingTrack `json:"tracks"`
+
+	// Owner is the subject of the principal that recorded it. Empty when recorded without authentication.
+	Owner string `json:"owner,omitempty"`
+
+	// KeyFrames indexes where each video key frame starts in the rtpdump stream.
+	KeyFrames []KeyFrame `json:"keyFrames,omitempty"`
+}
+
+// KeyFrame locates the first packet of a video key frame in a recording.
+type KeyFrame struct {
+	Offset float64 `json:"offset"` // seconds from the start of the recording
+	Packet int     `json:"packet"` // index of the packet among the recording's RTP packets
+}
+
+// RecordingTrack describes one of the media tracks interleaved in a recording's rtpdump stream.
+type RecordingTrack struct {
+	Kind        string `json:"kind"`
+	Codec       string `json:"codec"`
+	PayloadType uint8  `json:"payloadType"`
+	ClockRate   uint32 `json:"clockRate"`
+	SSRC        uint32 `json:"ssrc"`
+
+	// Packets that never arrived and were left out of the recording
+	PacketsLost int `json:"packetsLost,omitempty"`
+}
+
+// VideoCodec returns the name of the recording's video codec, or an empty string if unknown.
+func (r *Recording) VideoCodec() string {
+	for _, t := range r.Tracks {
+		if t.Kind == webrtc.RTPCodecTypeVideo.String() {
+			return t.Codec
+		}
+	}
+	return ""
+}
+
+// KeyFrameAt returns the last key frame at or before the given offset (in seconds), or the
+// first key frame if there is none before it. Returns nil when the recording has no key frame index.
+func (r *Recording) KeyFrameAt(offset float64) *KeyFrame {
+	if len(r.KeyFrames) == 0 {
+		return nil
+	}
+	i := sort.Search(len(r.KeyFrames), func(i int) bool { return r.KeyFrames[i].Offset > offset })
+	if i > 0 {
+		i--
+	}
+	return &r.KeyFrames[i]
+}
+
+// Track returns the track that packets with the given payload type belong to, or nil if unknown.
+func (r *Recording) Track(pt uint8) *RecordingTrack {
+	for i := range r.Tracks {
+		if r.Tracks[i].PayloadType == pt {
+			return &r.Tracks[i]
+		}
+	}
+	return nil
+}
+
+// RecordingStore - storage for recorded sessions. Each recording is kept as an rtpdump stream.
+type RecordingStore interface {
+	// Create starts a recording whose rtpdump stream is written to the store as it is recorded.
+	// The recording is not listed until the writer is committed.
+	Create(id string) (RecordingWriter, error)
+
+	// Put stores the rtpdump stream read from r under the given recording.
+	Put(rec *Recording, r io.Reader) error
+
+	// Get returns the recording with the given id.
+	Get(id string) (*Recording, error)
+
+	// List returns all recordings ordered by creation time.
+	List() []*Recording
+
+	// Delete removes the recording with the given id.
+	Delete(id string) error
+
+	// Open returns a reader over the rtpdump stream of the given recording.
+	Open(id string) (io.ReadCloser, error)
+
+	// Close flushes the store once the recordings being stored are complete. Recordings can no
+	// longer be stored once it is closed.
+	Close() error
+}
+
+// RecordingWriter writes the rtpdump stream of a recording in progress. It is not safe for concurrent use.
+type RecordingWriter interface {
+	io.Writer
+
+	// Open returns a reader over the stream written so far.
+	Open() (io.ReadCloser, error)
+
+	// Commit stores the stream written so far under the given recording and sets its size.
+	Commit(rec *Recording) error
+
+	// Abort discards the stream written so far.
+	Abort() error
+}
+
+// validRecordingID reports whether a recording id can be used as a file name in the store.
+func validRecordingID(id string) bool {
+	return id != "" && id == filepath.Base(id) && !strings.HasPrefix(id, ".")
+}
+
+// sortRecordings orders recordings by creation time (oldest first).
+func sortRecordings(recs []*Recording) []*Recording {
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].Created.Equal(recs[j].Created) {
+			return recs[i].ID < recs[j].ID
+		}
+		return recs[i].Created.Before(recs[j].Created)
+	})
+	return recs
+}
+
+// MemoryRecordingStore keeps recordings in memory. Recordings are lost when the process exits.
+type MemoryRecordingStore struct {
+	recordings map[string]*Recording
+	data       map[string][]byte
+	closed     bool
+
+	mutex sync.RWMutex
+}
+
+// CreateNewMemoryRecordingStore creates a new, empty in-memory recording store.
+func CreateNewMemoryRecordingStore() *MemoryRecordingStore {
+	return &MemoryRecordingStore{
+		recordings: make(map[string]*Recording),
+		data:       make(map[string][]byte),
+	}
+}
+
+// memoryRecordingWriter buffers the stream of a recording in progress until it is committed.
+type memoryRecordingWriter struct {
+	s   *MemoryRecordingStore
+	id  string
+	buf bytes.Buffer
+}
+
+func (w *memoryRecordingWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// Open returns a reader over the stream written so far.
+func (w *memoryRecordingWriter) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(w.buf.Bytes())), nil
+}
+
+// Commit stores the stream written so far under the given recording and sets its size.
+func (w *memoryRecordingWriter) Commit(rec *Recording) error {
+	rec.ID = w.id
+	rec.Size = int64(w.buf.Len())
+
+	stored := *rec
+	stored.Tracks = append([]RecordingTrack(nil), rec.Tracks...)
+
+	w.s.mutex.Lock()
+	defer w.s.mutex.Unlock()
+
+	if w.s.closed {
+		return ErrRecordingStoreClosed
+	}
+	w.s.recordings[w.id] = &stored
+	w.s.data[w.id] = w.buf.Bytes()
+	return nil
+}
+
+// Abort discards the stream written so far.
+func (w *memoryRecordingWriter) Abort() error {
+	w.buf = bytes.Buffer{}
+	return nil
+}
+
+// Create starts a recording whose rtpdump stream is buffered until the writer is committed.
+func (s *MemoryRecordingStore) Create(id string) (RecordingWriter, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.closed {
+		return nil, ErrRecordingStoreClosed
+	}
+	return &memoryRecordingWriter{s: s, id: id}, nil
+}
+
+// Put stores the rtpdump stream read from r under the given recording.
+func (s *MemoryRecordingStore) Put(rec *Recording, r io.Reader) error {
+	w := memoryRecordingWriter{s: s, id: rec.ID}
+	if _, err := io.Copy(&w, r); err != nil {
+		return err
+	}
+	return w.Commit(rec)
+}
+
+// Get returns the recording with the given id.
+func (s *MemoryRecordingStore) Get(id string) (*Recording, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rec, ok := s.recordings[id]
+	if !ok {
+		return nil, ErrRecordingNotFound
+	}
+	cp := *rec
+	return &cp, nil
+}
+
+// List returns all recordings ordered by creation time.
+func (s *MemoryRecordingStore) List() []*Recording {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	recs := make([]*Recording, 0, len(s.recordings))
+	for _, rec := range s.recordings {
+		cp := *rec
+		recs = append(recs, &cp)
+	}
+	return sortRecordings(recs)
+}
+
+// Delete removes the recording with the given id.
+func (s *MemoryRecordingStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.recordings[id]; !ok {
+		return ErrRecordingNotFound
+	}
+	delete(s.recordings, id)
+	delete(s.data, id)
+	return nil
+}
+
+// Open returns a reader over the rtpdump stream of the given recording.
+func (s *MemoryRecordingStore) Open(id string) (io.ReadCloser, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, ok := s.data[id]
+	if !ok {
+		return nil, ErrRecordingNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Close stops the store from accepting new recordings. Stored recordings can still be read.
+func (s *MemoryRecordingStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+const (
+	recordingDataExt = ".rtpdump"
+	recordingMetaExt = ".json"
+	recordingTempExt = ".tmp"
+)
+
+// FileRecordingStore keeps recordings in a directory on disk. Each recording is written as
+// <id>.rtpdump alongside a <id>.json metadata file. The catalog is reloaded from the
+// directory when the store is created.
+type FileRecordingStore struct {
+	dir        string
+	recordings map[string]*Recording
+	closed     bool
+
+	// Recordings being stored, waited on when the store is closed
+	storing sync.WaitGroup
+
+	mutex sync.RWMutex
+}
+
+// CreateNewFileRecordingStore creates a recording store backed by dir, creating the
+// directory if needed and loading any recordings already in it.
+func CreateNewFileRecordingStore(dir string) (*FileRecordingStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := FileRecordingStore{
+		dir:        dir,
+		recordings: make(map[string]*Recording),
+	}
+
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Recording store opened at %s with %d recordings.\n", dir, len(s.recordings))
+	return &s, nil
+}
+
+// load reads the metadata of every recording in the store directory.
+func (s *FileRecordingStore) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		// Streams of recordings that were in progress when the process died are never committed
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), recordingDataExt+recordingTempExt) {
+			log.Printf("Removing unfinished recording %s\n", fi.Name())
+			os.Remove(filepath.Join(s.dir, fi.Name()))
+			continue
+		}
+
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), recordingMetaExt) {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, fi.Name()))
+		if err != nil {
+			log.Printf("Skipping recording metadata %s: %s\n", fi.Name(), err)
+			continue
+		}
+
+		rec := Recording{}
+		err = json.Unmarshal(b, &rec)
+		if err != nil || rec.ID == "" {
+			log.Printf("Skipping recording metadata %s: %v\n", fi.Name(), err)
+			continue
+		}
+
+		if _, err = os.Stat(s.dataPath(rec.ID)); err != nil {
+			log.Printf("Skipping recording %s: %s\n", rec.ID, err)
+			continue
+		}
+
+		s.recordings[rec.ID] = &rec
+	}
+	return nil
+}
+
+func (s *FileRecordingStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+recordingDataExt)
+}
+
+func (s *FileRecordingStore) metaPath(id string) string {
+	return filepath.Join(s.dir, id+recordingMetaExt)
+}
+
+func (s *FileRecordingStore) tempPath(id string) string {
+	return s.dataPath(id) + recordingTempExt
+}
+
+// fileRecordingWriter writes the stream of a recording in progress to a temporary file, so a
+// partially written recording never appears in the catalog. The file is renamed when committed.
+type fileRecordingWriter struct {
+	s  *FileRecordingStore
+	id string
+	f  *os.File
+	w  *bufio.Writer
+	n  int64
+}
+
+func (w *fileRecordingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Open returns a reader over the stream written so far.
+func (w *fileRecordingWriter) Open() (io.ReadCloser, error) {
+	err := w.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(w.s.tempPath(w.id))
+}
+
+// Commit stores the stream written so far under the given recording and sets its size.
+// The store waits for it to complete when closed.
+func (w *fileRecordingWriter) Commit(rec *Recording) error {
+	err := w.s.beginStoring()
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	defer w.s.storing.Done()
+
+	return w.commit(rec)
+}
+
+func (w *fileRecordingWriter) commit(rec *Recording) error {
+	tmp := w.s.tempPath(w.id)
+
+	err := w.w.Flush()
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	rec.ID = w.id
+	rec.Size = w.n
+
+	stored := *rec
+	stored.Tracks = append([]RecordingTrack(nil), rec.Tracks...)
+
+	meta, err := json.MarshalIndent(&stored, "", "  ")
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	w.s.mutex.Lock()
+	defer w.s.mutex.Unlock()
+
+	err = os.Rename(tmp, w.s.dataPath(w.id))
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = ioutil.WriteFile(w.s.metaPath(w.id), meta, 0644)
+	if err != nil {
+		os.Remove(w.s.dataPath(w.id))
+		return err
+	}
+
+	w.s.recordings[w.id] = &stored
+	return nil
+}
+
+// Abort discards the stream written so far.
+func (w *fileRecordingWriter) Abort() error {
+	w.f.Close()
+	return os.Remove(w.s.tempPath(w.id))
+}
+
+// beginStoring registers a recording being stored so that Close waits for it.
+func (s *FileRecordingStore) beginStoring() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return ErrRecordingStoreClosed
+	}
+	s.storing.Add(1)
+	return nil
+}
+
+// Create starts a recording whose rtpdump stream is written to a temporary file in the store
+// directory as it is recorded.
+func (s *FileRecordingStore) Create(id string) (RecordingWriter, error) {
+	s.mutex.RLock()
+	closed := s.closed
+	s.mutex.RUnlock()
+
+	if closed {
+		return nil, ErrRecordingStoreClosed
+	}
+	return s.create(id)
+}
+
+func (s *FileRecordingStore) create(id string) (*fileRecordingWriter, error) {
+	if !validRecordingID(id) {
+		return nil, errors.New("invalid recording id")
+	}
+
+	f, err := os.Create(s.tempPath(id))
+	if err != nil {
+		return nil, err
+	}
+	return &fileRecordingWriter{s: s, id: id, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Put stores the rtpdump stream read from r under the given recording.
+func (s *FileRecordingStore) Put(rec *Recording, r io.Reader) error {
+	err := s.beginStoring()
+	if err != nil {
+		return err
+	}
+	defer s.storing.Done()
+
+	w, err := s.create(rec.ID)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.commit(rec)
+}
+
+// Get returns the recording with the given id.
+func (s *FileRecordingStore) Get(id string) (*Recording, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rec, ok := s.recordings[id]
+	if !ok {
+		return nil, ErrRecordingNotFound
+	}
+	cp := *rec
+	return &cp, nil
+}
+
+// List returns all recordings ordered by creation time.
+func (s *FileRecordingStore) List() []*Recording {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	recs := make([]*Recording, 0, len(s.recordings))
+	for _, rec := range s.recordings {
+		cp := *rec
+		recs = append(recs, &cp)
+	}
+	return sortRecordings(recs)
+}
+
+// Delete removes the recording with the given id.
+func (s *FileRecordingStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.recordings[id]; !ok {
+		return ErrRecordingNotFound
+	}
+	delete(s.recordings, id)
+
+	err := os.Remove(s.metaPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(s.dataPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Open returns a reader over the rtpdump stream of the given recording.
+func (s *FileRecordingStore) Open(id string) (io.ReadCloser, error) {
+	s.mutex.RLock()
+	_, ok := s.recordings[id]
+	s.mutex.RUnlock()
+
+	if !ok {
+		return nil, ErrRecordingNotFound
+	}
+	return os.Open(s.dataPath(id))
+}
+
+// Close waits for recordings being stored to complete and flushes the store directory to disk.
+// Recordings can no longer be stored once it is closed; recordings still in progress are discarded
+// when they are committed.
+func (s *FileRecordingStore) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mutex.Unlock()
+
+	s.storing.Wait()
+
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Recording store at %s closed with %d recordings.\n", s.dir, len(s.List()))
+	return nil
+}
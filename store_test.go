@@ -0,0 +1,221 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileRecordingStoreCloseWaitsForPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := CreateNewFileRecordingStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w := io.Pipe()
+	stored := make(chan error)
+	go func() {
+		stored <- s.Put(&Recording{ID: "rec"}, r)
+	}()
+
+	// Let Put start copying the stream before the store is closed
+	if _, err = w.Write([]byte("rtpdump")); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- s.Close()
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a recording was being stored")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.Close()
+	if err = <-stored; err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if err = <-closed; err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	rec, err := s.Get("rec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Size != int64(len("rtpdump")) {
+		t.Errorf("stored %d bytes, want %d", rec.Size, len("rtpdump"))
+	}
+
+	if err = s.Put(&Recording{ID: "late"}, strings.NewReader("")); err != ErrRecordingStoreClosed {
+		t.Errorf("Put after Close returned %v, want %v", err, ErrRecordingStoreClosed)
+	}
+}
+
+// testRecordingStores creates each kind of recording store. The returned func removes their files.
+func testRecordingStores(t *testing.T) (map[string]RecordingStore, func()) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := CreateNewFileRecordingStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	stores := map[string]RecordingStore{
+		"memory": CreateNewMemoryRecordingStore(),
+		"file":   fs,
+	}
+	return stores, func() { os.RemoveAll(dir) }
+}
+
+func TestRecordingStoreStreamsRecording(t *testing.T) {
+	stores, cleanup := testRecordingStores(t)
+	defer cleanup()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			w, err := s.Create("rec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, chunk := range []string{"rtp", "dump"} {
+				if _, err = w.Write([]byte(chunk)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The recording in progress can be read but is not listed until it is committed
+			rc, err := w.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(b) != "rtpdump" {
+				t.Errorf("read %q (%v) while recording, want %q", b, err, "rtpdump")
+			}
+			if _, err = s.Get("rec"); err != ErrRecordingNotFound {
+				t.Errorf("Get before Commit returned %v, want %v", err, ErrRecordingNotFound)
+			}
+
+			rec := Recording{Duration: 1.5}
+			if err = w.Commit(&rec); err != nil {
+				t.Fatal(err)
+			}
+			if rec.ID != "rec" || rec.Size != int64(len("rtpdump")) {
+				t.Errorf("committed id %q size %d, want %q size %d", rec.ID, rec.Size, "rec", len("rtpdump"))
+			}
+
+			stored, err := s.Get("rec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Duration != 1.5 || stored.Size != rec.Size {
+				t.Errorf("stored %+v, want %+v", stored, rec)
+			}
+
+			rc, err = s.Open("rec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(b) != "rtpdump" {
+				t.Errorf("read %q (%v), want %q", b, err, "rtpdump")
+			}
+		})
+	}
+}
+
+func TestRecordingStoreAbort(t *testing.T) {
+	stores, cleanup := testRecordingStores(t)
+	defer cleanup()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			w, err := s.Create("rec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte("rtpdump"))
+
+			if err = w.Abort(); err != nil {
+				t.Fatal(err)
+			}
+			if recs := s.List(); len(recs) != 0 {
+				t.Errorf("listed %d recordings after Abort", len(recs))
+			}
+		})
+	}
+}
+
+func TestRecordingStoreClosedDiscardsRecordingInProgress(t *testing.T) {
+	stores, cleanup := testRecordingStores(t)
+	defer cleanup()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			w, err := s.Create("rec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte("rtpdump"))
+
+			if err = s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err = w.Commit(&Recording{}); err != ErrRecordingStoreClosed {
+				t.Errorf("Commit after Close returned %v, want %v", err, ErrRecordingStoreClosed)
+			}
+			if _, err = s.Create("late"); err != ErrRecordingStoreClosed {
+				t.Errorf("Create after Close returned %v, want %v", err, ErrRecordingStoreClosed)
+			}
+		})
+	}
+}
+
+func TestFileRecordingStoreRemovesUnfinishedRecordings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := CreateNewFileRecordingStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := s.Create("rec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("rtpdump"))
+	w.(*fileRecordingWriter).w.Flush()
+
+	// Reopening the directory as if the process had died while recording
+	if _, err = CreateNewFileRecordingStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("%d files left in the store directory", len(files))
+	}
+}
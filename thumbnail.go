@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+	"golang.org/x/image/vp8"
+)
+
+var errThumbnailFound = errors.New("thumbnail found")
+
+// decodeVP8KeyFrame decodes a complete VP8 key frame into an image.
+func decodeVP8KeyFrame(decoder *vp8.Decoder, frame []byte) (*image.YCbCr, error) {
+	decoder.Init(bytes.NewReader(frame), len(frame))
+
+	fh, err := decoder.DecodeFrameHeader()
+	if err != nil {
+		return nil, err
+	}
+	if !fh.KeyFrame {
+		return nil, errors.New("not a vp8 key frame")
+	}
+
+	return decoder.DecodeFrame()
+}
+
+// RecordingThumbnail decodes the first key frame of a recording's video. Only VP8 video can be
+// decoded; recordings without track information are assumed to be VP8.
+func RecordingThumbnail(rec *Recording, r io.Reader) (*image.YCbCr, error) {
+	if codec := strings.ToUpper(rec.VideoCodec()); codec != "" && codec != webrtc.VP8 {
+		return nil, fmt.Errorf("thumbnails are not supported for %s video", codec)
+	}
+
+	decoder := vp8.NewDecoder()
+	var img *image.YCbCr
+
+	d := newVP8Depacketizer(func(frame []byte, ts uint32) error {
+		if !vp8IsKeyFrame(frame) {
+			return nil
+		}
+		var err error
+		img, err = decodeVP8KeyFrame(decoder, frame)
+		if err != nil {
+			// Keep looking, a later key frame may decode.
+			return nil
+		}
+		return errThumbnailFound
+	})
+
+	err := forEachTrackPacket(rec, r, webrtc.RTPCodecTypeVideo, d.push)
+	if err == nil {
+		err = d.flush()
+	}
+	if err != nil && err != errThumbnailFound {
+		return nil, err
+	}
+	if img == nil {
+		return nil, errNoKeyFrame
+	}
+	return img, nil
+}
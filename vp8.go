@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/pion/rtp"
+)
+
+var errShortVP8Packet = errors.New("vp8 payload too short")
+
+// vp8PayloadDescriptor holds the fields of the VP8 RTP payload descriptor that we use.
+// https://tools.ietf.org/html/rfc7741#section-4.2
+type vp8PayloadDescriptor struct {
+	// Size of the descriptor; the VP8 payload starts at this offset.
+	Size int
+
+	// StartOfPartition is set on the first packet of a partition.
+	StartOfPartition bool
+
+	// PartitionID is the partition the packet belongs to.
+	PartitionID uint8
+}
+
+// parseVP8PayloadDescriptor parses the payload descriptor at the start of a VP8 RTP payload.
+func parseVP8PayloadDescriptor(payload []byte) (vp8PayloadDescriptor, error) {
+	d := vp8PayloadDescriptor{}
+	if len(payload) < 1 {
+		return d, errShortVP8Packet
+	}
+
+	d.StartOfPartition = payload[0]&0x10 != 0
+	d.PartitionID = payload[0] & 0x07
+	d.Size = 1
+
+	if payload[0]&0x80 == 0 { // X: no extended control bits
+		return d, nil
+	}
+
+	if len(payload) < 2 {
+		return d, errShortVP8Packet
+	}
+	ext := payload[1]
+	d.Size++
+
+	if ext&0x80 != 0 { // I: picture id present
+		if len(payload) < d.Size+1 {
+			return d, errShortVP8Packet
+		}
+		if payload[d.Size]&0x80 != 0 { // M: 15 bit picture id
+			d.Size += 2
+		} else {
+			d.Size++
+		}
+	}
+	if ext&0x40 != 0 { // L: TL0PICIDX present
+		d.Size++
+	}
+	if ext&0x30 != 0 { // T or K: TID/Y/KEYIDX present
+		d.Size++
+	}
+
+	if len(payload) < d.Size {
+		return d, errShortVP8Packet
+	}
+	return d, nil
+}
+
+// vp8FrameStart returns the VP8 frame data of a packet if it carries the start of a frame.
+func vp8FrameStart(payload []byte) ([]byte, bool) {
+	d, err := parseVP8PayloadDescriptor(payload)
+	if err != nil || !d.StartOfPartition || d.PartitionID != 0 {
+		return nil, false
+	}
+	return payload[d.Size:], true
+}
+
+// vp8KeyFrameSize returns the dimensions of a VP8 key frame from the start of its frame data.
+// https://tools.ietf.org/html/rfc6386#section-9.1
+func vp8KeyFrameSize(frame []byte) (width, height int, ok bool) {
+	if len(frame) < 10 || frame[0]&0x01 != 0 {
+		return 0, 0, false
+	}
+	if frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0, false
+	}
+	width = int(binary.LittleEndian.Uint16(frame[6:8]) & 0x3fff)
+	height = int(binary.LittleEndian.Uint16(frame[8:10]) & 0x3fff)
+	return width, height, true
+}
+
+// vp8Depacketizer reassembles VP8 frames from RTP packets. Frames with missing packets are dropped.
+type vp8Depacketizer struct {
+	onFrame func(frame []byte, ts uint32) error
+
+	frame   []byte
+	ts      uint32
+	seq     uint16
+	started bool
+	broken  bool
+}
+
+func newVP8Depacketizer(onFrame func(frame []byte, ts uint32) error) *vp8Depacketizer {
+	return &vp8Depacketizer{onFrame: onFrame}
+}
+
+// push adds a packet to the frame being assembled, emitting the frame once complete.
+func (d *vp8Depacketizer) push(pkt *rtp.Packet) error {
+	desc, err := parseVP8PayloadDescriptor(pkt.Payload)
+	if err != nil {
+		return nil
+	}
+
+	if d.started && pkt.Timestamp != d.ts {
+		if err = d.flush(); err != nil {
+			return err
+		}
+	}
+
+	if desc.StartOfPartition && desc.PartitionID == 0 {
+		if d.frame != nil {
+			if err = d.flush(); err != nil {
+				return err
+			}
+		}
+		d.frame = []byte{}
+		d.broken = false
+	} else if d.frame == nil || !d.started || pkt.SequenceNumber != d.seq+1 {
+		// Either we have not seen the start of this frame or a packet is missing.
+		d.broken = true
+	}
+
+	d.started = true
+	d.ts = pkt.Timestamp
+	d.seq = pkt.SequenceNumber
+	if !d.broken {
+		d.frame = append(d.frame, pkt.Payload[desc.Size:]...)
+	}
+
+	if pkt.Marker {
+		return d.flush()
+	}
+	return nil
+}
+
+// flush emits the frame being assembled if it is complete.
+func (d *vp8Depacketizer) flush() error {
+	frame, broken := d.frame, d.broken
+	d.frame = nil
+	d.broken = false
+
+	if broken || len(frame) == 0 {
+		return nil
+	}
+	return d.onFrame(frame, d.ts)
+}
+
+// vp8IsKeyFrame reports whether the frame data is a VP8 key frame.
+func vp8IsKeyFrame(frame []byte) bool {
+	return len(frame) > 0 && frame[0]&0x01 == 0
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/pion/rtp"
+)
+
+var errShortVP9Packet = errors.New("vp9 payload too short")
+
+// vp9PayloadDescriptor holds the fields of the VP9 RTP payload descriptor that we use.
+// https://tools.ietf.org/html/draft-ietf-payload-vp9-16#section-4.2
+type vp9PayloadDescriptor struct {
+	// Size of the descriptor; the VP9 payload starts at this offset.
+	Size int
+
+	// InterPicture is set when the frame depends on a previous frame. Key frames have it cleared.
+	InterPicture bool
+
+	// StartOfFrame and EndOfFrame mark the first and last packet of a (layer) frame.
+	StartOfFrame bool
+	EndOfFrame   bool
+
+	// SpatialID is the spatial layer of the frame. Zero unless layer indices are present.
+	SpatialID uint8
+
+	// Width and Height of the lowest spatial layer when the scalability structure is present.
+	Width, Height int
+}
+
+// parseVP9PayloadDescriptor parses the payload descriptor at the start of a VP9 RTP payload.
+func parseVP9PayloadDescriptor(payload []byte) (vp9PayloadDescriptor, error) {
+	d := vp9PayloadDescriptor{}
+	if len(payload) < 1 {
+		return d, errShortVP9Packet
+	}
+
+	flags := payload[0]
+	d.InterPicture = flags&0x40 != 0
+	d.StartOfFrame = flags&0x08 != 0
+	d.EndOfFrame = flags&0x04 != 0
+	d.Size = 1
+
+	flexible := flags&0x10 != 0
+
+	if flags&0x80 != 0 { // I: picture id present
+		if len(payload) < d.Size+1 {
+			return d, errShortVP9Packet
+		}
+		if payload[d.Size]&0x80 != 0 { // M: 15 bit picture id
+			d.Size += 2
+		} else {
+			d.Size++
+		}
+	}
+
+	if flags&0x20 != 0 { // L: layer indices present
+		if len(payload) < d.Size+1 {
+			return d, errShortVP9Packet
+		}
+		d.SpatialID = (payload[d.Size] >> 1) & 0x07
+		d.Size++
+		if !flexible { // TL0PICIDX
+			d.Size++
+		}
+	}
+
+	if flexible && d.InterPicture { // reference indices, N marks another follows
+		for i := 0; i < 3; i++ {
+			if len(payload) < d.Size+1 {
+				return d, errShortVP9Packet
+			}
+			more := payload[d.Size]&0x01 != 0
+			d.Size++
+			if !more {
+				break
+			}
+		}
+	}
+
+	if flags&0x02 != 0 { // V: scalability structure present
+		if len(payload) < d.Size+1 {
+			return d, errShortVP9Packet
+		}
+		ss := payload[d.Size]
+		d.Size++
+
+		layers := int(ss>>5) + 1
+		if ss&0x10 != 0 { // Y: resolutions present
+			if len(payload) < d.Size+4*layers {
+				return d, errShortVP9Packet
+			}
+			d.Width = int(binary.BigEndian.Uint16(payload[d.Size:]))
+			d.Height = int(binary.BigEndian.Uint16(payload[d.Size+2:]))
+			d.Size += 4 * layers
+		}
+		if ss&0x08 != 0 { // G: picture group description present
+			if len(payload) < d.Size+1 {
+				return d, errShortVP9Packet
+			}
+			pictures := int(payload[d.Size])
+			d.Size++
+			for i := 0; i < pictures; i++ {
+				if len(payload) < d.Size+1 {
+					return d, errShortVP9Packet
+				}
+				refs := int(payload[d.Size]>>2) & 0x03
+				d.Size += 1 + refs
+			}
+		}
+	}
+
+	if len(payload) < d.Size {
+		return d, errShortVP9Packet
+	}
+	return d, nil
+}
+
+// vp9FrameStart returns the VP9 frame data of a packet if it carries the start of a frame
+// in the base spatial layer.
+func vp9FrameStart(payload []byte) ([]byte, bool) {
+	d, err := parseVP9PayloadDescriptor(payload)
+	if err != nil || !d.StartOfFrame || d.SpatialID != 0 {
+		return nil, false
+	}
+	return payload[d.Size:], true
+}
+
+// vp9FrameHeader holds the fields of the VP9 uncompressed frame header that we use.
+// https://storage.googleapis.com/downloads.webmproject.org/docs/vp9/vp9-bitstream-specification-v0.6-20160331-draft.pdf
+type vp9FrameHeader struct {
+	KeyFrame      bool
+	Width, Height int
+}
+
+// parseVP9FrameHeader parses the uncompressed header at the start of a VP9 frame. The size is
+// only known for key frames.
+func parseVP9FrameHeader(frame []byte) (vp9FrameHeader, error) {
+	h := vp9FrameHeader{}
+	r := h264BitReader{b: frame}
+
+	var err error
+	read := func(n int) uint {
+		if err != nil {
+			return 0
+		}
+		var v uint
+		v, err = r.bits(n)
+		return v
+	}
+
+	if read(2) != 2 { // frame_marker
+		return h, errors.New("not a vp9 frame")
+	}
+	profile := read(1) | read(1)<<1
+	if profile == 3 {
+		read(1) // reserved_zero
+	}
+	if read(1) == 1 { // show_existing_frame
+		return h, nil
+	}
+	h.KeyFrame = read(1) == 0 // frame_type
+	read(2)                   // show_frame, error_resilient_mode
+	if !h.KeyFrame {
+		return h, nil
+	}
+
+	if read(24) != 0x498342 { // frame_sync_code
+		return h, errors.New("invalid vp9 sync code")
+	}
+
+	// color_config
+	if profile >= 2 {
+		read(1) // ten_or_twelve_bit
+	}
+	if read(3) != 7 { // color_space != CS_RGB
+		read(1) // color_range
+		if profile == 1 || profile == 3 {
+			read(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		read(1) // reserved_zero
+	}
+
+	h.Width = int(read(16)) + 1
+	h.Height = int(read(16)) + 1
+	if err != nil {
+		return h, errShortVP9Packet
+	}
+	return h, nil
+}
+
+// vp9IsKeyFrame reports whether the frame data is a VP9 key frame.
+func vp9IsKeyFrame(frame []byte) bool {
+	h, err := parseVP9FrameHeader(frame)
+	return err == nil && h.KeyFrame
+}
+
+// vp9KeyFrameSize returns the dimensions of a VP9 key frame from the start of its frame data.
+func vp9KeyFrameSize(frame []byte) (width, height int, ok bool) {
+	h, err := parseVP9FrameHeader(frame)
+	if err != nil || !h.KeyFrame {
+		return 0, 0, false
+	}
+	return h.Width, h.Height, true
+}
+
+// vp9Depacketizer reassembles VP9 frames from RTP packets. The frames of the spatial layers of a
+// picture are combined into a superframe. Pictures with missing packets are dropped.
+type vp9Depacketizer struct {
+	onFrame func(frame []byte, ts uint32) error
+
+	frames  [][]byte
+	frame   []byte
+	ts      uint32
+	seq     uint16
+	started bool
+	broken  bool
+}
+
+func newVP9Depacketizer(onFrame func(frame []byte, ts uint32) error) *vp9Depacketizer {
+	return &vp9Depacketizer{onFrame: onFrame}
+}
+
+// push adds a packet to the picture being assembled, emitting the picture once complete.
+func (d *vp9Depacketizer) push(pkt *rtp.Packet) error {
+	desc, err := parseVP9PayloadDescriptor(pkt.Payload)
+	if err != nil {
+		return nil
+	}
+
+	if d.started && pkt.Timestamp != d.ts {
+		if err = d.flush(); err != nil {
+			return err
+		}
+	}
+
+	gap := d.started && pkt.SequenceNumber != d.seq+1
+	first := d.frame == nil && len(d.frames) == 0
+
+	if desc.StartOfFrame {
+		if d.frame != nil || (gap && !first) || (first && desc.SpatialID != 0) {
+			// The previous layer frame did not end, a layer frame is missing or
+			// we have not seen the base layer of this picture.
+			d.broken = true
+		}
+		d.frame = []byte{}
+	} else if d.frame == nil || gap {
+		// Either we have not seen the start of this frame or a packet is missing.
+		d.broken = true
+	}
+
+	d.started = true
+	d.ts = pkt.Timestamp
+	d.seq = pkt.SequenceNumber
+	if !d.broken && d.frame != nil {
+		d.frame = append(d.frame, pkt.Payload[desc.Size:]...)
+	}
+
+	if desc.EndOfFrame && d.frame != nil {
+		if len(d.frame) > 0 {
+			d.frames = append(d.frames, d.frame)
+		}
+		d.frame = nil
+	}
+
+	if pkt.Marker {
+		return d.flush()
+	}
+	return nil
+}
+
+// flush emits the picture being assembled if it is complete.
+func (d *vp9Depacketizer) flush() error {
+	frames, broken := d.frames, d.broken || d.frame != nil
+	d.frames = nil
+	d.frame = nil
+	d.broken = false
+
+	if broken || len(frames) == 0 {
+		return nil
+	}
+	if len(frames) == 1 {
+		return d.onFrame(frames[0], d.ts)
+	}
+	return d.onFrame(vp9Superframe(frames), d.ts)
+}
+
+// vp9Superframe combines the frames of a picture into a superframe with a trailing index.
+// https://storage.googleapis.com/downloads.webmproject.org/docs/vp9/vp9-bitstream-specification-v0.6-20160331-draft.pdf Annex B
+func vp9Superframe(frames [][]byte) []byte {
+	if len(frames) > 8 {
+		frames = frames[:8]
+	}
+
+	mag := 1
+	for _, f := range frames {
+		for mag < 4 && len(f) >= 1<<uint(8*mag) {
+			mag++
+		}
+	}
+
+	marker := byte(0xc0) | byte(mag-1)<<3 | byte(len(frames)-1)
+	out := []byte{}
+	for _, f := range frames {
+		out = append(out, f...)
+	}
+	out = append(out, marker)
+	for _, f := range frames {
+		size := len(f)
+		for i := 0; i < mag; i++ {
+			out = append(out, byte(size))
+			size >>= 8
+		}
+	}
+	return append(out, marker)
+}
+
+// vp9Payloader splits VP9 frames into RTP payloads using the non-flexible mode payload descriptor.
+type vp9Payloader struct {
+	pictureID uint16
+}
+
+// Payload fragments a VP9 frame across one or more byte arrays.
+func (p *vp9Payloader) Payload(mtu int, payload []byte) [][]byte {
+	const headerSize = 3
+
+	maxFragmentSize := mtu - headerSize
+	if maxFragmentSize <= 0 || len(payload) == 0 {
+		return nil
+	}
+
+	flags := byte(0x80) // I: 15 bit picture id follows
+	if !vp9IsKeyFrame(payload) {
+		flags |= 0x40 // P
+	}
+
+	out := [][]byte{}
+	for offset := 0; offset < len(payload); offset += maxFragmentSize {
+		size := len(payload) - offset
+		if size > maxFragmentSize {
+			size = maxFragmentSize
+		}
+
+		f := flags
+		if offset == 0 {
+			f |= 0x08 // B
+		}
+		if offset+size == len(payload) {
+			f |= 0x04 // E
+		}
+
+		pkt := make([]byte, headerSize+size)
+		pkt[0] = f
+		pkt[1] = 0x80 | byte(p.pictureID>>8)&0x7f
+		pkt[2] = byte(p.pictureID)
+		copy(pkt[headerSize:], payload[offset:offset+size])
+		out = append(out, pkt)
+	}
+
+	p.pictureID = (p.pictureID + 1) & 0x7fff
+	return out
+}
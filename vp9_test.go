@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// vp9TestKeyFrame returns the uncompressed header of a profile 0 VP9 key frame of the given size.
+func vp9TestKeyFrame(width, height uint) []byte {
+	w := h264TestBitWriter{}
+	w.bits(2, 2)         // frame_marker
+	w.bits(0, 2)         // profile
+	w.bits(0, 1)         // show_existing_frame
+	w.bits(0, 1)         // frame_type
+	w.bits(1, 1)         // show_frame
+	w.bits(0, 1)         // error_resilient_mode
+	w.bits(0x498342, 24) // frame_sync_code
+	w.bits(0, 3)         // color_space
+	w.bits(0, 1)         // color_range
+	w.bits(width-1, 16)
+	w.bits(height-1, 16)
+	return w.b
+}
+
+// vp9TestInterFrame is the start of a VP9 frame that is not a key frame.
+var vp9TestInterFrame = []byte{0x86, 0x00}
+
+func TestParseVP9PayloadDescriptor(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    vp9PayloadDescriptor
+		err     error
+	}{
+		{
+			name:    "minimal",
+			payload: []byte{0x0c},
+			want:    vp9PayloadDescriptor{Size: 1, StartOfFrame: true, EndOfFrame: true},
+		},
+		{
+			name:    "7 bit picture id",
+			payload: []byte{0xc8, 0x05},
+			want:    vp9PayloadDescriptor{Size: 2, InterPicture: true, StartOfFrame: true},
+		},
+		{
+			name:    "15 bit picture id",
+			payload: []byte{0x84, 0x81, 0x05},
+			want:    vp9PayloadDescriptor{Size: 3, EndOfFrame: true},
+		},
+		{
+			name:    "layer indices",
+			payload: []byte{0xa8, 0x05, 0x02, 0x00},
+			want:    vp9PayloadDescriptor{Size: 4, StartOfFrame: true, SpatialID: 1},
+		},
+		{
+			name:    "flexible mode references",
+			payload: []byte{0xd8, 0x05, 0x03, 0x04},
+			want:    vp9PayloadDescriptor{Size: 4, InterPicture: true, StartOfFrame: true},
+		},
+		{
+			name:    "scalability structure",
+			payload: []byte{0x8a, 0x05, 0x18, 0x01, 0x40, 0x00, 0xf0, 0x01, 0x04, 0x01},
+			want:    vp9PayloadDescriptor{Size: 10, StartOfFrame: true, Width: 320, Height: 240},
+		},
+		{
+			name:    "empty",
+			payload: []byte{},
+			err:     errShortVP9Packet,
+		},
+		{
+			name:    "truncated picture id",
+			payload: []byte{0x84, 0x81},
+			err:     errShortVP9Packet,
+		},
+		{
+			name:    "truncated scalability structure",
+			payload: []byte{0x0a, 0x10, 0x01, 0x40},
+			err:     errShortVP9Packet,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := parseVP9PayloadDescriptor(tt.payload)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err == nil && d != tt.want {
+				t.Errorf("got %+v, want %+v", d, tt.want)
+			}
+		})
+	}
+}
+
+func TestVP9KeyFrameSize(t *testing.T) {
+	width, height, ok := vp9KeyFrameSize(vp9TestKeyFrame(1280, 720))
+	if !ok || width != 1280 || height != 720 {
+		t.Errorf("got %dx%d (%v), want 1280x720", width, height, ok)
+	}
+
+	if _, _, ok = vp9KeyFrameSize(vp9TestInterFrame); ok {
+		t.Error("inter frame has a size")
+	}
+	if _, _, ok = vp9KeyFrameSize(vp9TestKeyFrame(1280, 720)[:5]); ok {
+		t.Error("truncated key frame has a size")
+	}
+	if vp9IsKeyFrame([]byte{0x00}) {
+		t.Error("frame without a frame marker is a key frame")
+	}
+}
+
+func TestVP9Superframe(t *testing.T) {
+	got := vp9Superframe([][]byte{{1, 2}, {3}})
+	want := []byte{1, 2, 3, 0xc1, 2, 1, 0xc1}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+
+	// Frames of 256 bytes or more need two bytes for their size
+	got = vp9Superframe([][]byte{make([]byte, 256), {3}})
+	want = []byte{0xc9, 0x00, 0x01, 0x01, 0x00, 0xc9}
+	if !bytes.Equal(got[256+1:], want) {
+		t.Errorf("got index %x, want %x", got[256+1:], want)
+	}
+}
+
+// vp9TestPacket is a VP9 RTP packet with a descriptor carrying layer indices.
+type vp9TestPacket struct {
+	seq        uint16
+	ts         uint32
+	spatialID  byte
+	start, end bool
+	marker     bool
+	data       []byte
+}
+
+func (p vp9TestPacket) rtp() *rtp.Packet {
+	flags := byte(0x20)
+	if p.start {
+		flags |= 0x08
+	}
+	if p.end {
+		flags |= 0x04
+	}
+	payload := append([]byte{flags, p.spatialID << 1, 0}, p.data...)
+	return &rtp.Packet{
+		Header:  rtp.Header{Marker: p.marker, SequenceNumber: p.seq, Timestamp: p.ts},
+		Payload: payload,
+	}
+}
+
+func TestVP9Depacketizer(t *testing.T) {
+	packets := []vp9TestPacket{
+		// A picture of one layer frame split over two packets
+		{seq: 1, ts: 0, start: true, data: []byte{1}},
+		{seq: 2, ts: 0, end: true, marker: true, data: []byte{2}},
+		// A picture of two spatial layers, combined into a superframe
+		{seq: 3, ts: 3000, start: true, end: true, data: []byte{3}},
+		{seq: 4, ts: 3000, spatialID: 1, start: true, end: true, marker: true, data: []byte{4}},
+		// The second packet of this picture is lost, so it is dropped
+		{seq: 5, ts: 6000, start: true, data: []byte{5}},
+		{seq: 7, ts: 6000, end: true, marker: true, data: []byte{7}},
+		// Only the second spatial layer of this picture is received, so it is dropped
+		{seq: 8, ts: 9000, spatialID: 1, start: true, end: true, marker: true, data: []byte{8}},
+		// This picture has no marker, so it ends when the timestamp changes
+		{seq: 9, ts: 12000, start: true, end: true, data: []byte{9}},
+		{seq: 10, ts: 15000, start: true, end: true, marker: true, data: []byte{10}},
+	}
+
+	type frame struct {
+		data []byte
+		ts   uint32
+	}
+	got := []frame{}
+	d := newVP9Depacketizer(func(data []byte, ts uint32) error {
+		got = append(got, frame{data, ts})
+		return nil
+	})
+	for _, p := range packets {
+		if err := d.push(p.rtp()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []frame{
+		{[]byte{1, 2}, 0},
+		{vp9Superframe([][]byte{{3}, {4}}), 3000},
+		{[]byte{9}, 12000},
+		{[]byte{10}, 15000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("frames %v, want %v", got, want)
+	}
+}
+
+func TestVP9PayloaderRoundTrip(t *testing.T) {
+	frame := append(vp9TestKeyFrame(640, 480), bytes.Repeat([]byte{0xaa}, 20)...)
+
+	p := vp9Payloader{pictureID: 0x7fff}
+	payloads := p.Payload(13, frame)
+	if len(payloads) != 3 {
+		t.Fatalf("got %d payloads, want 3", len(payloads))
+	}
+	if p.pictureID != 0 {
+		t.Errorf("picture id %d after wrapping, want 0", p.pictureID)
+	}
+
+	var got []byte
+	d := newVP9Depacketizer(func(data []byte, ts uint32) error {
+		got = data
+		return nil
+	})
+	for i, payload := range payloads {
+		desc, err := parseVP9PayloadDescriptor(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc.InterPicture {
+			t.Errorf("payload %d of a key frame marked as an inter picture", i)
+		}
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Marker: i == len(payloads)-1, SequenceNumber: uint16(i)},
+			Payload: payload,
+		}
+		if err = d.push(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, frame) {
+		t.Errorf("got frame %x, want %x", got, frame)
+	}
+
+	payloads = p.Payload(13, vp9TestInterFrame)
+	if desc, _ := parseVP9PayloadDescriptor(payloads[0]); !desc.InterPicture {
+		t.Error("inter frame not marked as an inter picture")
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// Matroska element ids used by the WebM muxer.
+// https://www.matroska.org/technical/elements.html
+const (
+	ebmlIDHeader             = 0x1a45dfa3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42f7
+	ebmlIDMaxIDLength        = 0x42f2
+	ebmlIDMaxSizeLength      = 0x42f3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+
+	mkvIDSegment           = 0x18538067
+	mkvIDInfo              = 0x1549a966
+	mkvIDTimecodeScale     = 0x2ad7b1
+	mkvIDDuration          = 0x4489
+	mkvIDMuxingApp         = 0x4d80
+	mkvIDWritingApp        = 0x5741
+	mkvIDTracks            = 0x1654ae6b
+	mkvIDTrackEntry        = 0xae
+	mkvIDTrackNumber       = 0xd7
+	mkvIDTrackUID          = 0x73c5
+	mkvIDTrackType         = 0x83
+	mkvIDCodecID           = 0x86
+	mkvIDCodecPrivate      = 0x63a2
+	mkvIDCodecDelay        = 0x56aa
+	mkvIDSeekPreRoll       = 0x56bb
+	mkvIDVideo             = 0xe0
+	mkvIDPixelWidth        = 0xb0
+	mkvIDPixelHeight       = 0xba
+	mkvIDAudio             = 0xe1
+	mkvIDSamplingFrequency = 0xb5
+	mkvIDChannels          = 0x9f
+	mkvIDCluster           = 0x1f43b675
+	mkvIDTimecode          = 0xe7
+	mkvIDSimpleBlock       = 0xa3
+)
+
+const (
+	mkvTrackTypeVideo = 1
+	mkvTrackTypeAudio = 2
+
+	// Blocks store their time as a signed 16 bit offset (in ms) from the cluster time.
+	mkvMaxClusterDuration = 30 * time.Second
+
+	// webmInterleaveWindow is how long frames wait for the other track before being written
+	// anyway. Recordings are stored in capture order, so the tracks are never far apart.
+	webmInterleaveWindow = 2 * time.Second
+)
+
+// ebmlUnknownSize marks an element whose size is not known when it is written, so that the
+// segment can be streamed.
+var ebmlUnknownSize = []byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+var errEmptyWebM = errors.New("recording contains no media to export")
+
+// ebmlID encodes an element id. Ids already include their length marker bits.
+func ebmlID(id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<16:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<8:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id)}
+}
+
+// ebmlSize encodes an element data size as a variable length integer.
+func ebmlSize(size uint64) []byte {
+	length := 1
+	for length < 8 && size >= (uint64(1)<<uint(7*length))-1 {
+		length++
+	}
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(size)
+		size >>= 8
+	}
+	b[0] |= byte(0x80 >> uint(length-1))
+	return b
+}
+
+func ebmlElement(id uint32, data ...[]byte) []byte {
+	size := 0
+	for _, d := range data {
+		size += len(d)
+	}
+	el := append(ebmlID(id), ebmlSize(uint64(size))...)
+	for _, d := range data {
+		el = append(el, d...)
+	}
+	return el
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	length := 1
+	for length < 8 && v>>uint(8*length) != 0 {
+		length++
+	}
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(v))
+	return ebmlElement(id, b)
+}
+
+func ebmlString(id uint32, v string) []byte {
+	return ebmlElement(id, []byte(v))
+}
+
+// webmFrame is a single video frame or audio packet to be muxed.
+type webmFrame struct {
+	track    uint64
+	time     time.Duration
+	keyFrame bool
+	data     []byte
+}
+
+// webmMuxer writes VP8 or VP9 video frames and Opus audio packets as a WebM file. Frames are
+// interleaved by time and written a cluster at a time as they are added, so only the current
+// cluster is held in memory.
+type webmMuxer struct {
+	w             io.Writer
+	codec         string
+	width, height int
+	duration      time.Duration
+	hasVideo      bool
+	hasAudio      bool
+
+	started     bool
+	start       time.Duration
+	pending     map[uint64][]webmFrame
+	clusterTime time.Duration
+	blocks      [][]byte
+}
+
+const (
+	webmVideoTrack = 1
+	webmAudioTrack = 2
+)
+
+// newWebMMuxer creates a muxer writing the tracks of a recording to w. The recording's analyzed
+// duration is written in the header as the clusters are written before the last frame is known.
+func newWebMMuxer(w io.Writer, rec *Recording) *webmMuxer {
+	m := &webmMuxer{
+		w:        w,
+		codec:    strings.ToUpper(rec.VideoCodec()),
+		width:    rec.Width,
+		height:   rec.Height,
+		duration: time.Duration(rec.Duration * float64(time.Second)),
+		hasVideo: len(rec.Tracks) == 0, // recordings without track information only contain video
+		pending:  map[uint64][]webmFrame{},
+	}
+	for _, t := range rec.Tracks {
+		switch t.Kind {
+		case webrtc.RTPCodecTypeVideo.String():
+			m.hasVideo = true
+		case webrtc.RTPCodecTypeAudio.String():
+			m.hasAudio = true
+		}
+	}
+	return m
+}
+
+// addVideoFrame adds a video frame captured at t. Frames before the first key frame are dropped
+// so the video can be decoded from the beginning.
+func (m *webmMuxer) addVideoFrame(frame []byte, t time.Duration) error {
+	keyFrame := vp8IsKeyFrame(frame)
+	if m.codec == webrtc.VP9 {
+		keyFrame = vp9IsKeyFrame(frame)
+	}
+
+	if !m.started {
+		if !keyFrame {
+			return nil
+		}
+		if m.width == 0 {
+			w, h, ok := vp8KeyFrameSize(frame)
+			if m.codec == webrtc.VP9 {
+				w, h, ok = vp9KeyFrameSize(frame)
+			}
+			if ok {
+				m.width, m.height = w, h
+			}
+		}
+		if err := m.writeHeader(t); err != nil {
+			return err
+		}
+	}
+	return m.add(webmFrame{track: webmVideoTrack, time: t, keyFrame: keyFrame, data: frame})
+}
+
+// addAudioPacket adds an audio packet captured at t. Audio before the first video key frame is
+// dropped so audio and video start together.
+func (m *webmMuxer) addAudioPacket(packet []byte, t time.Duration) error {
+	if !m.started {
+		if m.hasVideo {
+			return nil
+		}
+		if err := m.writeHeader(t); err != nil {
+			return err
+		}
+	}
+	data := append([]byte(nil), packet...)
+	return m.add(webmFrame{track: webmAudioTrack, time: t, keyFrame: true, data: data})
+}
+
+// add queues a frame and writes the queued frames that can no longer be preceded by a frame of
+// the other track.
+func (m *webmMuxer) add(f webmFrame) error {
+	if f.time < m.start {
+		return nil
+	}
+	m.pending[f.track] = append(m.pending[f.track], f)
+	return m.interleave(false)
+}
+
+// interleave writes the queued frames in time order. Frames wait until the other track has a
+// frame queued too, unless the file has no other track, the queue spans webmInterleaveWindow
+// or all frames have been added.
+func (m *webmMuxer) interleave(final bool) error {
+	for {
+		video, audio := m.pending[webmVideoTrack], m.pending[webmAudioTrack]
+
+		track := uint64(webmVideoTrack)
+		if len(video) == 0 || (len(audio) > 0 && audio[0].time < video[0].time) {
+			track = webmAudioTrack
+		}
+		queue, other := m.pending[track], m.pending[webmVideoTrack+webmAudioTrack-track]
+		if len(queue) == 0 {
+			return nil
+		}
+
+		ready := final || len(other) > 0 ||
+			(track == webmVideoTrack && !m.hasAudio) || (track == webmAudioTrack && !m.hasVideo) ||
+			queue[len(queue)-1].time-queue[0].time >= webmInterleaveWindow
+		if !ready {
+			return nil
+		}
+
+		m.pending[track] = queue[1:]
+		if err := m.writeFrame(queue[0]); err != nil {
+			return err
+		}
+	}
+}
+
+// writeFrame adds a frame to the current cluster. A new cluster is started on each video key
+// frame and before the block time offsets would overflow.
+func (m *webmMuxer) writeFrame(f webmFrame) error {
+	t := f.time - m.start
+	if m.blocks == nil ||
+		t-m.clusterTime >= mkvMaxClusterDuration ||
+		(f.track == webmVideoTrack && f.keyFrame) {
+		if err := m.flushCluster(); err != nil {
+			return err
+		}
+		m.clusterTime = t - t%time.Millisecond
+	}
+
+	flags := byte(0)
+	if f.keyFrame {
+		flags = 0x80
+	}
+	header := make([]byte, 4)
+	header[0] = 0x80 | byte(f.track)
+	binary.BigEndian.PutUint16(header[1:], uint16(int16((t-m.clusterTime)/time.Millisecond)))
+	header[3] = flags
+
+	m.blocks = append(m.blocks, ebmlElement(mkvIDSimpleBlock, header, f.data))
+	return nil
+}
+
+// flushCluster writes the current cluster.
+func (m *webmMuxer) flushCluster() error {
+	if len(m.blocks) == 0 {
+		return nil
+	}
+	cluster := append([][]byte{ebmlUint(mkvIDTimecode, uint64(m.clusterTime/time.Millisecond))}, m.blocks...)
+	m.blocks = nil
+
+	_, err := m.w.Write(ebmlElement(mkvIDCluster, cluster...))
+	return err
+}
+
+func (m *webmMuxer) codecID() string {
+	if m.codec == webrtc.VP9 {
+		return "V_VP9"
+	}
+	return "V_VP8"
+}
+
+func (m *webmMuxer) tracks() []byte {
+	entries := [][]byte{}
+	if m.hasVideo {
+		entries = append(entries, ebmlElement(mkvIDTrackEntry,
+			ebmlUint(mkvIDTrackNumber, webmVideoTrack),
+			ebmlUint(mkvIDTrackUID, webmVideoTrack),
+			ebmlUint(mkvIDTrackType, mkvTrackTypeVideo),
+			ebmlString(mkvIDCodecID, m.codecID()),
+			ebmlElement(mkvIDVideo,
+				ebmlUint(mkvIDPixelWidth, uint64(m.width)),
+				ebmlUint(mkvIDPixelHeight, uint64(m.height)),
+			),
+		))
+	}
+	if m.hasAudio {
+		entries = append(entries, ebmlElement(mkvIDTrackEntry,
+			ebmlUint(mkvIDTrackNumber, webmAudioTrack),
+			ebmlUint(mkvIDTrackUID, webmAudioTrack),
+			ebmlUint(mkvIDTrackType, mkvTrackTypeAudio),
+			ebmlString(mkvIDCodecID, "A_OPUS"),
+			ebmlElement(mkvIDCodecPrivate, opusHead()),
+			ebmlUint(mkvIDCodecDelay, uint64(time.Duration(opusPreSkip)*time.Second/audioClockRate)),
+			ebmlUint(mkvIDSeekPreRoll, uint64(80*time.Millisecond)),
+			ebmlElement(mkvIDAudio,
+				ebmlFloat(mkvIDSamplingFrequency, audioClockRate),
+				ebmlUint(mkvIDChannels, opusChannels),
+			),
+		))
+	}
+	return ebmlElement(mkvIDTracks, entries...)
+}
+
+// writeHeader writes the EBML header and opens the segment with its info and tracks. The
+// segment starts at start, the time of the first frame written.
+func (m *webmMuxer) writeHeader(start time.Duration) error {
+	m.started = true
+	m.start = start
+
+	header := ebmlElement(ebmlIDHeader,
+		ebmlUint(ebmlIDVersion, 1),
+		ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4),
+		ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlString(ebmlIDDocType, "webm"),
+		ebmlUint(ebmlIDDocTypeVersion, 4),
+		ebmlUint(ebmlIDDocTypeReadVersion, 2),
+	)
+
+	info := [][]byte{ebmlUint(mkvIDTimecodeScale, uint64(time.Millisecond))}
+	if duration := m.duration - start; duration > 0 {
+		info = append(info, ebmlFloat(mkvIDDuration, float64(duration)/float64(time.Millisecond)))
+	}
+	info = append(info,
+		ebmlString(mkvIDMuxingApp, "pion-the-sky"),
+		ebmlString(mkvIDWritingApp, "pion-the-sky"),
+	)
+
+	// The segment is streamed, so its size is left unknown
+	segment := append(ebmlID(mkvIDSegment), ebmlUnknownSize...)
+	segment = append(segment, ebmlElement(mkvIDInfo, info...)...)
+	segment = append(segment, m.tracks()...)
+
+	if _, err := m.w.Write(header); err != nil {
+		return err
+	}
+	_, err := m.w.Write(segment)
+	return err
+}
+
+// Close writes the frames still queued and the last cluster.
+func (m *webmMuxer) Close() error {
+	if !m.started {
+		return errEmptyWebM
+	}
+	if err := m.interleave(true); err != nil {
+		return err
+	}
+	return m.flushCluster()
+}
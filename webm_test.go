@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2/pkg/media/rtpdump"
+)
+
+// ebmlTestVint reads a variable length integer, keeping the length marker bits for element ids.
+// Returns the value, its length and whether all the value bits are set (an unknown size).
+func ebmlTestVint(b []byte, marker bool) (v uint64, n int, unknown bool) {
+	n = 1
+	for n <= 8 && b[0]&(0x80>>uint(n-1)) == 0 {
+		n++
+	}
+	all := true
+	for i := 0; i < n; i++ {
+		c := b[i]
+		if i == 0 && !marker {
+			c &= 0xff >> uint(n)
+		}
+		if i == 0 && c != 0xff>>uint(n) || i > 0 && c != 0xff {
+			all = false
+		}
+		v = v<<8 | uint64(c)
+	}
+	return v, n, all && !marker
+}
+
+// ebmlTestWalk calls fn for each element in b. Elements of unknown size run to the end of b.
+func ebmlTestWalk(t *testing.T, b []byte, fn func(id uint32, data []byte)) {
+	for len(b) > 0 {
+		id, n, _ := ebmlTestVint(b, true)
+		b = b[n:]
+		size, n, unknown := ebmlTestVint(b, false)
+		b = b[n:]
+		if unknown {
+			size = uint64(len(b))
+		}
+		if size > uint64(len(b)) {
+			t.Fatalf("element %x overruns its parent", id)
+		}
+		fn(uint32(id), b[:size])
+		b = b[size:]
+	}
+}
+
+// webmTestBlock is a SimpleBlock read back from a WebM file.
+type webmTestBlock struct {
+	track    int
+	time     int // ms
+	keyFrame bool
+}
+
+func webmTestBlocks(t *testing.T, b []byte) []webmTestBlock {
+	blocks := []webmTestBlock{}
+	ebmlTestWalk(t, b, func(id uint32, data []byte) {
+		if id != mkvIDSegment {
+			return
+		}
+		ebmlTestWalk(t, data, func(id uint32, data []byte) {
+			if id != mkvIDCluster {
+				return
+			}
+			clusterTime := 0
+			ebmlTestWalk(t, data, func(id uint32, data []byte) {
+				switch id {
+				case mkvIDTimecode:
+					for _, c := range data {
+						clusterTime = clusterTime<<8 | int(c)
+					}
+				case mkvIDSimpleBlock:
+					blocks = append(blocks, webmTestBlock{
+						track:    int(data[0] & 0x7f),
+						time:     clusterTime + int(int16(binary.BigEndian.Uint16(data[1:3]))),
+						keyFrame: data[3]&0x80 != 0,
+					})
+				}
+			})
+		})
+	})
+	return blocks
+}
+
+func TestEBMLSize(t *testing.T) {
+	tests := []struct {
+		size uint64
+		want []byte
+	}{
+		{0, []byte{0x80}},
+		{126, []byte{0xfe}},
+		{127, []byte{0x40, 0x7f}},
+		{16382, []byte{0x7f, 0xfe}},
+		{16383, []byte{0x20, 0x3f, 0xff}},
+	}
+	for _, tt := range tests {
+		if got := ebmlSize(tt.size); !bytes.Equal(got, tt.want) {
+			t.Errorf("ebmlSize(%d) = %x, want %x", tt.size, got, tt.want)
+		}
+	}
+}
+
+// vp8TestPayload is a VP8 RTP payload: the payload descriptor and the start of a frame.
+func vp8TestPayload(start, keyFrame bool) []byte {
+	desc := byte(0x00)
+	if start {
+		desc = 0x10
+	}
+	if keyFrame {
+		// Key frame tag, start code and a 320x240 frame size
+		return []byte{desc, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x40, 0x01, 0xf0, 0x00}
+	}
+	return []byte{desc, 0x01, 0x00, 0x00}
+}
+
+func TestExportWebMSkipsDroppedFrames(t *testing.T) {
+	rec := &Recording{
+		Tracks: []RecordingTrack{{Kind: "video", Codec: "VP8", PayloadType: 96, ClockRate: videoClockRate}},
+	}
+
+	packets := []struct {
+		seq      uint16
+		ts       uint32
+		start    bool
+		keyFrame bool
+	}{
+		{1, 0, true, true},
+		{2, 3000, true, false}, // the rest of this frame is lost, so it is dropped
+		{4, 3000, false, false},
+		{5, 6000, true, false},
+		{6, 9000, true, false},
+		{7, 12000, true, true},
+	}
+
+	buf := bytes.Buffer{}
+	dw, err := rtpdump.NewWriter(&buf, rtpdump.Header{Start: time.Unix(9, 0).UTC(), Source: net.IPv4(2, 2, 2, 2), Port: 2222})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range packets {
+		pkt := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         p.seq != 2,
+				PayloadType:    96,
+				SequenceNumber: p.seq,
+				Timestamp:      p.ts,
+			},
+			Payload: vp8TestPayload(p.start, p.keyFrame),
+		}
+		raw, err := pkt.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := time.Duration(p.ts) * time.Second / videoClockRate
+		if err = dw.WritePacket(rtpdump.Packet{Offset: offset, Payload: raw}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := bytes.Buffer{}
+	if err = exportWebM(rec, &buf, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []webmTestBlock{
+		{webmVideoTrack, 0, true},
+		{webmVideoTrack, 66, false},
+		{webmVideoTrack, 100, false},
+		{webmVideoTrack, 133, true},
+	}
+	if got := webmTestBlocks(t, out.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("blocks %+v, want %+v", got, want)
+	}
+}
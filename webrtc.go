@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"image"
 	"image/png"
@@ -9,9 +8,9 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v2"
 	"golang.org/x/image/vp8"
@@ -19,53 +18,91 @@ import (
 
 // WebRTCService server implementation
 type WebRTCService struct {
-	api    *webrtc.API
-	config webrtc.Configuration
-	m      webrtc.MediaEngine
-	ac     *webrtc.RTPCodec
-	vc     *webrtc.RTPCodec
-	Videos map[string]*bytes.Buffer //TODO: Make this a sync.Map
+	settings   webrtc.SettingEngine
+	config     webrtc.Configuration
+	ac         *webrtc.RTPCodec
+	nat        *NATMapping
+	Recordings RecordingStore
+
+	// Video codecs that can be negotiated, in order of preference
+	videoCodecs []string
+
+	live      map[string]*LiveSession
+	liveMutex sync.Mutex
 }
 
 // CreateNewWebRTCService creates a new webrtc server instance
-func CreateNewWebRTCService(videoCodec *webrtc.RTPCodec) (*WebRTCService, error) {
+func CreateNewWebRTCService(store RecordingStore, cfg *Config) (*WebRTCService, error) {
+	var err error
 
-	svc := WebRTCService{Videos: make(map[string]*bytes.Buffer)}
-	svc.ac = webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, 48000)
-	svc.vc = videoCodec
+	svc := WebRTCService{
+		Recordings: store,
+		live:       make(map[string]*LiveSession),
+	}
+	svc.ac = webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, audioClockRate)
+
+	// The video codec is negotiated per client, preferring the configured codec
+	svc.videoCodecs, err = videoCodecPreference(cfg.VideoCodec)
+	if err != nil {
+		return nil, err
+	}
 
-	// Selected Codecs
-	svc.m.RegisterCodec(svc.ac)
-	svc.m.RegisterCodec(svc.vc)
+	svc.settings, err = cfg.SettingEngine()
+	if err != nil {
+		return nil, err
+	}
 
-	svc.api = webrtc.NewAPI(webrtc.WithMediaEngine(svc.m))
+	svc.config, err = cfg.WebRTCConfiguration()
+	if err != nil {
+		return nil, err
+	}
 
-	svc.config = webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+	svc.nat, err = cfg.NATMapping()
+	if err != nil {
+		return nil, err
 	}
 
-	log.Printf("WebRTC services started with [Audio:%s, Video:%s]\n", svc.ac.Name, svc.vc.Name)
+	log.Printf("WebRTC services started with [Audio:%s, Video:%s]\n", svc.ac.Name, strings.Join(svc.videoCodecs, ","))
 	return &svc, nil
 }
 
+// newPeerConnection creates the client's peer connection. Each client gets its own media engine
+// so only its negotiated video codec is offered in the answer. Clients signaled over the websocket
+// trickle their candidates, so their answer is sent before gathering finishes. HTTP clients (WHIP
+// and WHEP) have no way to trickle, so they gather every candidate before answering.
+func (svc *WebRTCService) newPeerConnection(client *PeerClient) error {
+	var err error
+
+	m := webrtc.MediaEngine{}
+	m.RegisterCodec(webrtc.NewRTPOpusCodec(svc.ac.PayloadType, audioClockRate))
+	m.RegisterCodec(client.vc)
+
+	settings := svc.settings
+	settings.SetTrickle(client.ws != nil)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(settings))
+
+	client.pc, err = api.NewPeerConnection(svc.config)
+	return err
+}
+
 // CreateRecordingConnection creates a new webrtc peer connection on the server for recording and streaming playback.
 func (svc *WebRTCService) CreateRecordingConnection(client *PeerClient) error {
 	var err error
 
 	// Create a new peer connection
-	client.pc, err = svc.api.NewPeerConnection(svc.config)
+	err = svc.newPeerConnection(client)
 	if err != nil {
 		return err
 	}
 
+	// Viewers can watch the recording while it is in progress
+	client.live = svc.StartLiveSession(client.id, client.principal.Subject, client.vc.Name, client.requestKeyFrame)
+
 	// Create receive track
-	inputTrack, err := client.pc.NewTrack(svc.vc.PayloadType, rand.Uint32(), "video", "pion")
+	inputTrack, err := client.pc.NewTrack(client.vc.PayloadType, rand.Uint32(), "video", "pion")
 	if err != nil {
-		log.Printf("Client pt=%d pion-pt:%d\n", client.pt, svc.vc.PayloadType)
+		log.Printf("Client pt=%d pion-pt:%d\n", client.pt, client.vc.PayloadType)
 		panic(err)
 	}
 
@@ -74,25 +111,25 @@ func (svc *WebRTCService) CreateRecordingConnection(client *PeerClient) error {
 		panic(err)
 	}
 
+	// Create the audio receive track
+	inputAudioTrack, err := client.pc.NewTrack(svc.ac.PayloadType, rand.Uint32(), "audio", "pion")
+	if err != nil {
+		return err
+	}
+	if _, err = client.pc.AddTrack(inputAudioTrack); err != nil {
+		return err
+	}
+
 	// Handler - Process audio/video as it is received
 	client.pc.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
 		log.Printf("Client %s %s track ready\n", client.id, track.Codec().Name)
 
-		// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-		go func() {
-			ticker := time.NewTicker(time.Second * 3)
-			for range ticker.C {
-				if client.IsClosed() {
-					return
-				}
-
-				err := client.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}})
-				if err != nil {
-					fmt.Printf("OnTrack ticker exiting for client %s (%s)\n", client.id, err)
-					return
-				}
-			}
-		}()
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			// Start the recording on a key frame. Further key frames are requested on packet
+			// loss and when live viewers join.
+			client.setVideoSSRC(track.SSRC())
+			client.requestKeyFrame("connected")
+		}
 
 		go client.recordTrack(track)
 	})
@@ -100,6 +137,7 @@ func (svc *WebRTCService) CreateRecordingConnection(client *PeerClient) error {
 	// Handler - Detect connects, disconnects & closures
 	client.pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		log.Printf("Client %s connection State has changed %s \n", client.id, connectionState.String())
+		client.setICEState(connectionState)
 
 		if connectionState == webrtc.ICEConnectionStateConnected {
 			log.Printf("Client %s connected to webrtc services as peer.\n", client.id)
@@ -108,6 +146,7 @@ func (svc *WebRTCService) CreateRecordingConnection(client *PeerClient) error {
 			connectionState == webrtc.ICEConnectionStateClosed {
 
 			log.Printf("Client %s disconnected from webrtc services as peer.\n", client.id)
+			client.closeIfUnsignaled(connectionState)
 		}
 	})
 
@@ -121,39 +160,75 @@ func (svc *WebRTCService) CreateRecordingConnection(client *PeerClient) error {
 
 // CreatePlaybackConnection creates a new webrtc peer connection on the server for recording and streaming playback.
 func (svc *WebRTCService) CreatePlaybackConnection(client *PeerClient) error {
+	return svc.createStreamingConnection(client, client.streamVideoToTrack)
+}
+
+// CreateLiveConnection creates a new webrtc peer connection on the server for watching a recording in progress.
+func (svc *WebRTCService) CreateLiveConnection(client *PeerClient, session *LiveSession) error {
+	return svc.createStreamingConnection(client, func(video, audio *trackRewriter) {
+		client.streamLiveToTrack(session, video, audio)
+	})
+}
+
+// createStreamingConnection creates a peer connection that sends video and audio to the browser.
+// stream is started once the browser has connected.
+func (svc *WebRTCService) createStreamingConnection(client *PeerClient, stream func(video, audio *trackRewriter)) error {
 	var err error
 
 	// Create a new peer connection
-	client.pc, err = svc.api.NewPeerConnection(svc.config)
+	err = svc.newPeerConnection(client)
 	if err != nil {
 		return err
 	}
 
 	// Create Track that we send video back to browser on
-	outputTrack, err := client.pc.NewTrack(svc.vc.PayloadType, rand.Uint32(), "video", "pion")
+	outputTrack, err := client.pc.NewTrack(client.vc.PayloadType, rand.Uint32(), "video", "pion")
 	if err != nil {
 		panic(err)
 	}
 
 	// Add this newly created track to the PeerConnection
-	if _, err = client.pc.AddTrack(outputTrack); err != nil {
+	videoSender, err := client.pc.AddTrack(outputTrack)
+	if err != nil {
 		panic(err)
 	}
 
+	// Create the Track that we send audio back to browser on. It shares the video track's
+	// label so the browser places both in the same stream and keeps them in sync.
+	outputAudioTrack, err := client.pc.NewTrack(svc.ac.PayloadType, rand.Uint32(), "audio", "pion")
+	if err != nil {
+		return err
+	}
+	audioSender, err := client.pc.AddTrack(outputAudioTrack)
+	if err != nil {
+		return err
+	}
+
+	// Send sender reports on both tracks and read the receiver reports and NACKs the browser sends back
+	videoStats, videoSent := newSenderStats(outputTrack), newRetransmitBuffer()
+	audioStats, audioSent := newSenderStats(outputAudioTrack), newRetransmitBuffer()
+	client.setSenderStats(videoStats, audioStats)
+	go client.readSenderRTCP(videoSender, outputTrack, videoStats, videoSent)
+	go client.readSenderRTCP(audioSender, outputAudioTrack, audioStats, audioSent)
+	go client.sendSenderReports(videoStats, audioStats)
+
 	// Handler - Detect connects, disconnects & closures
 	client.pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		log.Printf("Client %s connection State has changed %s \n", client.id, connectionState.String())
+		client.setICEState(connectionState)
 
 		if connectionState == webrtc.ICEConnectionStateConnected {
 			log.Printf("Client %s connected to webrtc services as peer.\n", client.id)
 
-			go client.streamVideoToTrack(outputTrack)
+			go stream(newTrackRewriter(outputTrack, client.pt, videoStats, videoSent),
+				newTrackRewriter(outputAudioTrack, client.apt, audioStats, audioSent))
 
 		} else if connectionState == webrtc.ICEConnectionStateFailed ||
 			connectionState == webrtc.ICEConnectionStateDisconnected ||
 			connectionState == webrtc.ICEConnectionStateClosed {
 
 			log.Printf("Client %s disconnected from webrtc services as peer.\n", client.id)
+			client.closeIfUnsignaled(connectionState)
 		}
 	})
 
@@ -165,16 +240,53 @@ func (svc *WebRTCService) CreatePlaybackConnection(client *PeerClient) error {
 	return nil
 }
 
-// SaveVideo stores video packets in a globally available map for streaming playback
-func (svc *WebRTCService) SaveVideo(id string, packets *bytes.Buffer) {
-	svc.Videos[id] = packets
-	log.Printf("Video saved in memory for Client %s. %d bytes.\n", id, packets.Len())
-	log.Printf("%d total videos in memory.\n", svc.VideoCount())
+// SaveVideo commits the audio and video packets written to the recording store while recording, for
+// streaming playback under the subject of the principal that recorded them.
+func (svc *WebRTCService) SaveVideo(id, owner string, recording RecordingWriter, tracks []RecordingTrack) {
+	if recording == nil || len(tracks) == 0 {
+		log.Printf("Nothing was recorded for Client %s.\n", id)
+		return
+	}
+
+	rec := Recording{
+		ID:      id,
+		Created: time.Now().UTC(),
+		Tracks:  tracks,
+		Owner:   owner,
+	}
+
+	rc, err := recording.Open()
+	if err == nil {
+		err = AnalyzeRecording(&rec, rc)
+		rc.Close()
+	}
+	if err != nil {
+		log.Printf("Unable to analyze video for Client %s: %s\n", id, err)
+	}
+
+	err = recording.Commit(&rec)
+	if err != nil {
+		log.Printf("Unable to save video for Client %s: %s\n", id, err)
+		return
+	}
+	log.Printf("Video saved for Client %s. %d bytes.\n", id, rec.Size)
+	log.Printf("%d total videos stored.\n", len(svc.Recordings.List()))
+}
+
+// VideoCount returns the number of stored videos the principal may play back
+func (svc *WebRTCService) VideoCount(p *Principal) int {
+	return len(svc.ReadableRecordings(p))
 }
 
-// VideoCount returns the number or stored videos for streaming playback
-func (svc *WebRTCService) VideoCount() int {
-	return len(svc.Videos)
+// ReadableRecordings returns the stored recordings the principal may play back, oldest first.
+func (svc *WebRTCService) ReadableRecordings(p *Principal) []*Recording {
+	recs := []*Recording{}
+	for _, rec := range svc.Recordings.List() {
+		if p.CanRead(rec) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
 }
 
 // RTPToString compiles the rtp header fields into a string for logging.
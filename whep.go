@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// whepHandler serves WebRTC-HTTP egress (WHEP) so that any WHEP player can watch without the
+// signal socket. https://datatracker.ietf.org/doc/draft-murillo-whep/
+//
+// POST /whep/{id} with an SDP offer responds with the SDP answer. A recording in progress with
+// the id is watched live, otherwise the stored recording is played back in a loop. The Location
+// header names the session, /whep/{id}/{session}. DELETE /whep/{id}/{session} ends it.
+func (s *SignalServer) whepHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/whep"), "/"), "/")
+	id := parts[0]
+	if id == "" || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if p := s.authorize(w, r, ""); p != nil {
+			s.deleteHTTPSession(w, p, parts[1], PctPlayback, PctLive)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.isShuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	p := s.authorize(w, r, "")
+	if p == nil {
+		return
+	}
+
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+
+	// Find what to watch before creating a client for it. Whatever the caller may not watch is not found.
+	session, err := s.services.LiveSession(id)
+	if err == nil && !p.CanWatch(session) {
+		session, err = nil, ErrLiveSessionNotFound
+	}
+	if err != nil {
+		rec, err := s.services.Recordings.Get(id)
+		if err != nil || !p.CanRead(rec) {
+			http.Error(w, "recording not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	c, err := CreateNewHTTPPeerClient(r.RemoteAddr, p, s.services, s.clients)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.browserSD = offer
+
+	if session != nil {
+		_, err = c.negotiate(func(offered []string) (string, error) {
+			if !containsCodec(offered, session.codec) {
+				return "", fmt.Errorf("the player cannot play %s video", session.codec)
+			}
+			return session.codec, nil
+		})
+	} else {
+		_, err = c.negotiate(func(offered []string) (string, error) {
+			return s.services.PlaybackCodec(p, []string{id}, offered)
+		})
+	}
+	if err != nil {
+		c.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if session != nil {
+		c.setType(PctLive)
+		log.Printf("Client %s watching live session %s over WHEP.\n", c.id, id)
+		err = s.services.CreateLiveConnection(c, session)
+	} else {
+		c.setType(PctPlayback)
+		c.playlist = []string{id}
+		c.control = newPlaybackControl()
+		log.Printf("Client %s playing back %s with %s video over WHEP.\n", c.id, id, c.vc.Name)
+		err = s.services.CreatePlaybackConnection(c)
+	}
+	if err != nil {
+		log.Printf("Client %s error %s\n", c.id, err)
+		c.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAnswer(w, c, "/whep/"+id+"/"+c.id)
+}
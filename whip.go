@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// maxOfferSize bounds the SDP offers read from WHIP and WHEP requests.
+const maxOfferSize = 64 * 1024
+
+// sdpContentType is the content type of WHIP and WHEP offers and answers.
+const sdpContentType = "application/sdp"
+
+// readOffer reads the SDP offer in the body of a WHIP or WHEP request and encodes it like the
+// session descriptions sent over the signal socket. The error response is written on failure.
+func readOffer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != sdpContentType {
+		http.Error(w, "content type must be "+sdpContentType, http.StatusUnsupportedMediaType)
+		return "", false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "unable to read the offer", http.StatusBadRequest)
+		return "", false
+	}
+	if len(body) == 0 {
+		http.Error(w, "missing sdp offer", http.StatusBadRequest)
+		return "", false
+	}
+
+	return Encode(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}), true
+}
+
+// writeAnswer responds to a WHIP or WHEP request with the client's SDP answer. location is the
+// resource that ends the session when deleted.
+func writeAnswer(w http.ResponseWriter, c *PeerClient, location string) {
+	answer := webrtc.SessionDescription{}
+	if err := TryDecode(c.serverSD, &answer); err != nil {
+		c.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	_, err := w.Write([]byte(answer.SDP))
+	if err != nil {
+		log.Printf("Client %s unable to write the answer: %s\n", c.id, err)
+	}
+}
+
+// deleteHTTPSession serves DELETE on a WHIP or WHEP session resource, closing the HTTP client
+// with the id if it is one of the given types. Only the principal that started the session, or
+// an admin, can end it. Closing a recording client saves its recording.
+func (s *SignalServer) deleteHTTPSession(w http.ResponseWriter, p *Principal, id string, types ...PeerClientType) {
+	c := s.clients.Get(id)
+	if c != nil && c.ws == nil && (p.HasRole(RoleAdmin) || p.owns(c.principal.Subject)) {
+		ct := c.Info().Type
+		for _, t := range types {
+			if ct == t.String() {
+				c.Close()
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+	}
+	http.Error(w, "session not found", http.StatusNotFound)
+}
+
+// whipHandler serves WebRTC-HTTP ingestion (WHIP) so that any WHIP encoder can record without
+// the signal socket. https://datatracker.ietf.org/doc/draft-ietf-wish-whip/
+//
+// POST /whip with an SDP offer starts a recording and responds with the SDP answer. The
+// Location header names the session, /whip/{id}, where id is the recording id.
+// DELETE /whip/{id} ends the session and saves the recording.
+func (s *SignalServer) whipHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/whip"), "/")
+	if id != "" {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if p := s.authorize(w, r, ""); p != nil {
+			s.deleteHTTPSession(w, p, id, PctRecord)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.isShuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	p := s.authorize(w, r, RoleRecord)
+	if p == nil {
+		return
+	}
+
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+
+	c, err := CreateNewHTTPPeerClient(r.RemoteAddr, p, s.services, s.clients)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.browserSD = offer
+	codec, err := c.negotiate(s.services.RecordingCodec)
+	if err != nil {
+		c.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.setType(PctRecord)
+	log.Printf("Client %s recording with %s video over WHIP.\n", c.id, codec)
+
+	err = s.services.CreateRecordingConnection(c)
+	if err != nil {
+		log.Printf("Client %s error %s\n", c.id, err)
+		c.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAnswer(w, c, "/whip/"+c.id)
+}